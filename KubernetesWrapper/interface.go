@@ -0,0 +1,60 @@
+package kuberneteswrapper
+
+import (
+	"context"
+	"io"
+
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+/*
+The operations on the cluster that handlers and services use. KubernetesWrapper implements it
+over a kubernetes.Interface, so it runs against the cluster or a fake clientset alike.
+*/
+type Interface interface {
+	BuildLabel(key string, value []string) (*labels.Requirement, error)
+
+	// image builders
+	CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod, error)
+	GetImageBuilderWatcher(ctx context.Context, name string, namespace string) (watch.Interface, error)
+	DeleteImageBuilder(options *DeleteOptions) error
+	ListImageBuilders(ctx context.Context, namespace string) ([]corev1.Pod, error)
+	ListBuildPods(ctx context.Context, namespace string, buildId string) ([]corev1.Pod, error)
+
+	// pods and their logs
+	GetPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error)
+	ListSitePods(ctx context.Context, namespace string, siteId string) ([]corev1.Pod, error)
+	GetPodLogs(ctx context.Context, namespace string, podName string, container string) (string, error)
+	StreamPodLogs(ctx context.Context, namespace string, podName string, container string, follow bool) (io.ReadCloser, error)
+
+	// site deployments and services
+	CreateDeployment(options *DeploymentOptions) (*v1.Deployment, error)
+	GetDeployment(ctx context.Context, namespace string, name string) (*v1.Deployment, error)
+	GetDeploymentWatcher(ctx context.Context, label string, namespace string) (watch.Interface, error)
+	UpdateDeployment(options *UpdateOptions) error
+	PatchDeploymentImage(options *UpdateOptions) (*v1.Deployment, error)
+	DeleteDeployment(options *DeleteOptions) error
+	CreateService(options *ServiceOptions) (*corev1.Service, error)
+	GetService(ctx context.Context, namespace string, name string) (*corev1.Service, error)
+	DeleteService(options *DeleteOptions) error
+
+	// namespaces of projects
+	CreateNamespace(ctx context.Context, namespace string, labels map[string]string, annotations map[string]string) error
+	DeleteNamespace(ctx context.Context, namespace string) error
+	GetSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error)
+	CopySecret(ctx context.Context, fromNamespace string, name string, toNamespace string) error
+	ApplyProjectLimits(ctx context.Context, namespace string, limits ProjectLimits) error
+
+	// scaling
+	ApplyAutoscaler(ctx context.Context, namespace string, name string, scaling Scaling) error
+	DeleteAutoscaler(ctx context.Context, namespace string, name string) error
+	UpdateDeploymentScaling(ctx context.Context, namespace string, name string, scaling Scaling) error
+	ScaleDeployment(ctx context.Context, namespace string, name string, replicas int32) error
+	WakeDeployment(ctx context.Context, namespace string, name string, replicas int32) error
+	WaitDeploymentReady(ctx context.Context, namespace string, name string) error
+}
+
+var _ Interface = &KubernetesWrapper{}
@@ -0,0 +1,190 @@
+package kuberneteswrapper
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// label of the namespaces and the objects in them created by the service
+const managedByLabel = "app.kubernetes.io/managed-by"
+const managedBy = "cloudbase-ssh"
+
+// names of the quota and limit range of a project's namespace
+const projectQuota = "cloudbase-quota"
+const projectLimits = "cloudbase-limits"
+
+// Limits of a project's plan, applied to its namespace
+type ProjectLimits struct {
+	// pods of all the sites and builds of the project together
+	Pods int
+	// cpu and memory limits of all the pods of the project together
+	CPU    string
+	Memory string
+	// limits of a single container. also the limits of containers that don't set their own,
+	// eg: the image builders
+	ContainerCPU    string
+	ContainerMemory string
+}
+
+/*
+Creates a namespace with the given labels and annotations. The labels and annotations of a
+namespace that already exists are updated.
+*/
+func (kw *KubernetesWrapper) CreateNamespace(
+	ctx context.Context,
+	namespace string,
+	labels map[string]string,
+	annotations map[string]string,
+) error {
+	namespaces := kw.KClient.CoreV1().Namespaces()
+
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[managedByLabel] = managedBy
+
+	_, err := namespaces.Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: labels, Annotations: annotations},
+	}, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := namespaces.Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		existing.Labels[key] = value
+	}
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		existing.Annotations[key] = value
+	}
+	_, err = namespaces.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// Deletes a namespace with everything in it, if it exists. The namespace is removed in the
+// background.
+func (kw *KubernetesWrapper) DeleteNamespace(ctx context.Context, namespace string) error {
+	err := kw.KClient.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (kw *KubernetesWrapper) GetSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	return kw.KClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Copies a secret to another namespace, eg: the registry credentials to the namespace of a
+// project. A copy that already exists is updated.
+func (kw *KubernetesWrapper) CopySecret(ctx context.Context, fromNamespace string, name string, toNamespace string) error {
+	secret, err := kw.KClient.CoreV1().Secrets(fromNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	secrets := kw.KClient.CoreV1().Secrets(toNamespace)
+	_, err = secrets.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{managedByLabel: managedBy}},
+		Type:       secret.Type,
+		Data:       secret.Data,
+	}, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Data = secret.Data
+	_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+/*
+Applies the limits of a project's plan to its namespace, with a resource quota on all of its
+pods and a limit range on each container. Containers that don't set limits get the limits of
+a container, which the quota requires them to have.
+*/
+func (kw *KubernetesWrapper) ApplyProjectLimits(ctx context.Context, namespace string, limits ProjectLimits) error {
+	cpu, err := resource.ParseQuantity(limits.CPU)
+	if err != nil {
+		return err
+	}
+	memory, err := resource.ParseQuantity(limits.Memory)
+	if err != nil {
+		return err
+	}
+	containerCPU, err := resource.ParseQuantity(limits.ContainerCPU)
+	if err != nil {
+		return err
+	}
+	containerMemory, err := resource.ParseQuantity(limits.ContainerMemory)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{managedByLabel: managedBy}
+
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: projectQuota, Labels: labels},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				corev1.ResourcePods:         *resource.NewQuantity(int64(limits.Pods), resource.DecimalSI),
+				corev1.ResourceLimitsCPU:    cpu,
+				corev1.ResourceLimitsMemory: memory,
+			},
+		},
+	}
+	quotas := kw.KClient.CoreV1().ResourceQuotas(namespace)
+	existingQuota, err := quotas.Get(ctx, projectQuota, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = quotas.Create(ctx, quota, metav1.CreateOptions{})
+	} else if err == nil {
+		existingQuota.Spec = quota.Spec
+		_, err = quotas.Update(ctx, existingQuota, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	containerLimits := corev1.ResourceList{
+		corev1.ResourceCPU:    containerCPU,
+		corev1.ResourceMemory: containerMemory,
+	}
+	limitRange := &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: projectLimits, Labels: labels},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{{
+				Type:    corev1.LimitTypeContainer,
+				Max:     containerLimits,
+				Default: containerLimits,
+			}},
+		},
+	}
+	limitRanges := kw.KClient.CoreV1().LimitRanges(namespace)
+	existingLimits, err := limitRanges.Get(ctx, projectLimits, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = limitRanges.Create(ctx, limitRange, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existingLimits.Spec = limitRange.Spec
+	_, err = limitRanges.Update(ctx, existingLimits, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,204 @@
+package kuberneteswrapper
+
+import (
+	"context"
+	"time"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// How a site's deployment is scaled, and the resources of each of its pods
+type Scaling struct {
+	MinReplicas int32
+	// with more replicas than MinReplicas the deployment is scaled by an autoscaler
+	MaxReplicas int32
+	// average cpu utilisation the autoscaler keeps, in percent of the cpu request
+	TargetCPU int32
+	// quantities such as 100m or 128Mi. empty ones are not set
+	CPURequest    string
+	CPULimit      string
+	MemoryRequest string
+	MemoryLimit   string
+}
+
+// Whether the deployment is scaled by an autoscaler
+func (s Scaling) Autoscaled() bool {
+	return s.MaxReplicas > s.MinReplicas
+}
+
+// Returns the requests and limits of a site's container. Errors if a quantity can't be parsed.
+func (s Scaling) Resources() (corev1.ResourceRequirements, error) {
+	requirements := corev1.ResourceRequirements{}
+	set := func(list *corev1.ResourceList, name corev1.ResourceName, value string) error {
+		if value == "" {
+			return nil
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[name] = quantity
+		return nil
+	}
+
+	if err := set(&requirements.Requests, corev1.ResourceCPU, s.CPURequest); err != nil {
+		return requirements, err
+	}
+	if err := set(&requirements.Requests, corev1.ResourceMemory, s.MemoryRequest); err != nil {
+		return requirements, err
+	}
+	if err := set(&requirements.Limits, corev1.ResourceCPU, s.CPULimit); err != nil {
+		return requirements, err
+	}
+	if err := set(&requirements.Limits, corev1.ResourceMemory, s.MemoryLimit); err != nil {
+		return requirements, err
+	}
+	return requirements, nil
+}
+
+/*
+Creates or updates the autoscaler of a deployment. The autoscaler is named after the
+deployment. Deployments with a fixed number of replicas have their autoscaler removed.
+*/
+func (kw *KubernetesWrapper) ApplyAutoscaler(ctx context.Context, namespace string, name string, scaling Scaling) error {
+	autoscalers := kw.KClient.AutoscalingV1().HorizontalPodAutoscalers(namespace)
+
+	if !scaling.Autoscaled() {
+		return kw.DeleteAutoscaler(ctx, namespace, name)
+	}
+
+	minReplicas := scaling.MinReplicas
+	spec := autoscalingv1.HorizontalPodAutoscalerSpec{
+		ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Name:       name,
+		},
+		MinReplicas:                    &minReplicas,
+		MaxReplicas:                    scaling.MaxReplicas,
+		TargetCPUUtilizationPercentage: &scaling.TargetCPU,
+	}
+
+	autoscaler, err := autoscalers.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = autoscalers.Create(ctx, &autoscalingv1.HorizontalPodAutoscaler{
+			TypeMeta:   metav1.TypeMeta{Kind: "HorizontalPodAutoscaler", APIVersion: "autoscaling/v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"app": name}},
+			Spec:       spec,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	autoscaler.Spec = spec
+	_, err = autoscalers.Update(ctx, autoscaler, metav1.UpdateOptions{})
+	return err
+}
+
+// Deletes the autoscaler of a deployment if it has one
+func (kw *KubernetesWrapper) DeleteAutoscaler(ctx context.Context, namespace string, name string) error {
+	err := kw.KClient.AutoscalingV1().
+		HorizontalPodAutoscalers(namespace).
+		Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+Sets the resources of a deployment's container, which rolls out new pods if they changed. The
+replicas are only set for deployments with a fixed number of them, otherwise they are left to
+the autoscaler. Deployments scaled to zero are left asleep, they get their replicas when woken.
+*/
+func (kw *KubernetesWrapper) UpdateDeploymentScaling(ctx context.Context, namespace string, name string, scaling Scaling) error {
+	resources, err := scaling.Resources()
+	if err != nil {
+		return err
+	}
+
+	deployment, err := kw.KClient.AppsV1().
+		Deployments(namespace).
+		Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	deployment.Spec.Template.Spec.Containers[0].Resources = resources
+	if !scaling.Autoscaled() && (deployment.Spec.Replicas == nil || *deployment.Spec.Replicas > 0) {
+		replicas := scaling.MinReplicas
+		deployment.Spec.Replicas = &replicas
+	}
+
+	_, err = kw.KClient.AppsV1().
+		Deployments(namespace).
+		Update(ctx, deployment, metav1.UpdateOptions{})
+	return err
+}
+
+// Sets the number of replicas of a deployment. An autoscaler of the deployment pauses while it
+// has none.
+func (kw *KubernetesWrapper) ScaleDeployment(ctx context.Context, namespace string, name string, replicas int32) error {
+	deployments := kw.KClient.AppsV1().Deployments(namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := deployments.GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		scale.Spec.Replicas = replicas
+		_, err = deployments.UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Scales a deployment with no replicas up to the given number. Deployments that have replicas
+// are left as they are, so the replicas added by an autoscaler are kept.
+func (kw *KubernetesWrapper) WakeDeployment(ctx context.Context, namespace string, name string, replicas int32) error {
+	deployments := kw.KClient.AppsV1().Deployments(namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := deployments.GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if scale.Spec.Replicas > 0 {
+			return nil
+		}
+		scale.Spec.Replicas = replicas
+		_, err = deployments.UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Polls the deployment until one of its pods is ready, or ctx is done
+func (kw *KubernetesWrapper) WaitDeploymentReady(ctx context.Context, namespace string, name string) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		deployment, err := kw.GetDeployment(ctx, namespace, name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && deployment.Status.ReadyReplicas > 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package kuberneteswrapper
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// where the deploy key secret is mounted in the init container
+const deployKeyPath = "/etc/git-secret"
+
+// A git repository the image builder clones instead of fetching an upload from the worker queue
+type GitSource struct {
+	RepoURL string
+	// branch, tag or commit to build. the default branch when empty
+	Ref string
+	// directory of the repository the site is in. the root when empty
+	Subdirectory string
+	// name of a kubernetes.io/ssh-auth secret with the deploy key for private repositories
+	DeployKeySecret string
+}
+
+/*
+Returns the shell script that clones the source into <workspace>/src.
+
+The repository, ref and subdirectory are read from the REPO_URL, GIT_REF and SUBDIRECTORY env
+variables so they never have to be quoted. Only the ref is fetched, with a depth of 1. The
+commit that was checked out is printed so it ends up in the build logs.
+*/
+func CloneScript(workspace string) string {
+	return `set -e
+rm -rf ` + workspace + `/repo ` + workspace + `/src
+git init -q ` + workspace + `/repo
+cd ` + workspace + `/repo
+git remote add origin "$REPO_URL"
+git fetch -q --depth 1 origin "${GIT_REF:-HEAD}"
+git -c advice.detachedHead=false checkout -q FETCH_HEAD
+echo "Cloned $REPO_URL at $(git rev-parse HEAD)"
+test -d "./${SUBDIRECTORY:-.}" || { echo "directory $SUBDIRECTORY not found in the repository"; exit 1; }
+mkdir -p ` + workspace + `/src
+cp -a "./${SUBDIRECTORY:-.}/." ` + workspace + `/src/
+rm -rf ` + workspace + `/src/.git
+`
+}
+
+// env variables the clone script reads
+func (gs *GitSource) env() []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{Name: "REPO_URL", Value: gs.RepoURL},
+		{Name: "GIT_REF", Value: gs.Ref},
+		{Name: "SUBDIRECTORY", Value: gs.Subdirectory},
+	}
+	if gs.DeployKeySecret != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "GIT_SSH_COMMAND",
+			Value: "ssh -i " + deployKeyPath + "/ssh-privatekey -o StrictHostKeyChecking=accept-new",
+		})
+	}
+	return env
+}
+
+// volume with the deploy key. nil without a deploy key
+func (gs *GitSource) volume() *corev1.Volume {
+	if gs.DeployKeySecret == "" {
+		return nil
+	}
+	mode := int32(0400)
+	return &corev1.Volume{
+		Name: "deploykey",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName:  gs.DeployKeySecret,
+			DefaultMode: &mode,
+		}},
+	}
+}
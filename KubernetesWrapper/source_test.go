@@ -0,0 +1,225 @@
+package kuberneteswrapper
+
+import (
+	"io/ioutil"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runs git in dir with a fixed author and no user or system config
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HOME="+dir, "GIT_CONFIG_NOSYSTEM=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v : %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commits of the test repository
+type testRepo struct {
+	bare   string
+	first  string // tagged v1
+	main   string
+	branch string // head of the feature branch
+}
+
+/*
+Creates a bare repository with two commits on main, the first tagged v1, and a feature
+branch. The site is in the site folder, with a README next to it.
+*/
+func newTestRepo(t *testing.T) testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	work := filepath.Join(root, "work")
+	repo := testRepo{bare: filepath.Join(root, "site.git")}
+
+	git(t, root, "init", "-q", "-b", "main", work)
+	writeFile(t, filepath.Join(work, "README.md"), "readme")
+	writeFile(t, filepath.Join(work, "site", "index.html"), "v1")
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-q", "-m", "first")
+	git(t, work, "tag", "v1")
+	repo.first = git(t, work, "rev-parse", "HEAD")
+
+	writeFile(t, filepath.Join(work, "site", "index.html"), "v2")
+	git(t, work, "commit", "-q", "-am", "second")
+	repo.main = git(t, work, "rev-parse", "HEAD")
+
+	git(t, work, "checkout", "-q", "-b", "feature")
+	writeFile(t, filepath.Join(work, "site", "index.html"), "feature")
+	git(t, work, "commit", "-q", "-am", "feature")
+	repo.branch = git(t, work, "rev-parse", "HEAD")
+	git(t, work, "checkout", "-q", "main")
+
+	git(t, root, "clone", "-q", "--bare", work, repo.bare)
+	return repo
+}
+
+// Serves the repositories in the folder of the bare repository with git's smart http backend
+func serveRepo(t *testing.T, repo testRepo) string {
+	t.Helper()
+	execPath := git(t, t.TempDir(), "--exec-path")
+	server := httptest.NewServer(&cgi.Handler{
+		Path:   filepath.Join(execPath, "git-http-backend"),
+		Env:    []string{"GIT_PROJECT_ROOT=" + filepath.Dir(repo.bare), "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: ioutil.Discard,
+	})
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(repo.bare)
+}
+
+/*
+Runs the clone script of source the way the builder's init container does, with the env of
+the source. Returns the workspace, the script's output and its error.
+*/
+func runCloneScript(t *testing.T, source *GitSource, extraEnv ...string) (string, string, error) {
+	t.Helper()
+	workspace := t.TempDir()
+	cmd := exec.Command("/bin/sh", "-c", CloneScript(workspace))
+	cmd.Env = append(os.Environ(), "HOME="+workspace, "GIT_CONFIG_NOSYSTEM=1", "GIT_TERMINAL_PROMPT=0")
+	for _, env := range source.env() {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	cmd.Env = append(cmd.Env, extraEnv...)
+	out, err := cmd.CombinedOutput()
+	return workspace, string(out), err
+}
+
+func readSrc(t *testing.T, workspace string, name string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(workspace, "src", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestCloneScript(t *testing.T) {
+	repo := newTestRepo(t)
+	url := serveRepo(t, repo)
+
+	tests := []struct {
+		name         string
+		ref          string
+		subdirectory string
+		commit       string
+		file         string
+		content      string
+	}{
+		{name: "default branch", commit: repo.main, file: "site/index.html", content: "v2"},
+		{name: "branch", ref: "feature", commit: repo.branch, file: "site/index.html", content: "feature"},
+		{name: "tag", ref: "v1", commit: repo.first, file: "site/index.html", content: "v1"},
+		{name: "commit", ref: repo.first, commit: repo.first, file: "site/index.html", content: "v1"},
+		{name: "subdirectory", ref: "main", subdirectory: "site", commit: repo.main, file: "index.html", content: "v2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workspace, out, err := runCloneScript(t, &GitSource{RepoURL: url, Ref: test.ref, Subdirectory: test.subdirectory})
+			if err != nil {
+				t.Fatalf("clone failed : %v\n%s", err, out)
+			}
+			if !strings.Contains(out, "Cloned "+url+" at "+test.commit) {
+				t.Errorf("output doesn't have the commit %v :\n%s", test.commit, out)
+			}
+			if content := readSrc(t, workspace, test.file); content != test.content {
+				t.Errorf("%v = %q, want %q", test.file, content, test.content)
+			}
+			if _, err := os.Stat(filepath.Join(workspace, "src", ".git")); !os.IsNotExist(err) {
+				t.Error("src has the .git folder")
+			}
+			if test.subdirectory != "" {
+				if _, err := os.Stat(filepath.Join(workspace, "src", "README.md")); !os.IsNotExist(err) {
+					t.Error("src has files from outside the subdirectory")
+				}
+			}
+		})
+	}
+
+	t.Run("missing subdirectory", func(t *testing.T) {
+		_, out, err := runCloneScript(t, &GitSource{RepoURL: url, Subdirectory: "docs"})
+		if err == nil || !strings.Contains(out, "directory docs not found") {
+			t.Errorf("err = %v, output :\n%s", err, out)
+		}
+	})
+	t.Run("unknown ref", func(t *testing.T) {
+		if _, out, err := runCloneScript(t, &GitSource{RepoURL: url, Ref: "nope"}); err == nil {
+			t.Errorf("clone of an unknown ref succeeded :\n%s", out)
+		}
+	})
+	t.Run("unknown repository", func(t *testing.T) {
+		if _, out, err := runCloneScript(t, &GitSource{RepoURL: url + "-nope"}); err == nil {
+			t.Errorf("clone of an unknown repository succeeded :\n%s", out)
+		}
+	})
+}
+
+/*
+Private repositories are cloned over ssh with the deploy key. An ssh on the PATH stands in for
+the real one: it records its arguments and runs the command git asks the server to run
+against the local repository.
+*/
+func TestCloneScriptDeployKey(t *testing.T) {
+	repo := newTestRepo(t)
+
+	bin := t.TempDir()
+	argsFile := filepath.Join(bin, "args")
+	writeFile(t, filepath.Join(bin, "ssh"), `#!/bin/sh
+echo "$@" > `+argsFile+`
+for last; do :; done
+exec sh -c "$last"
+`)
+	if err := os.Chmod(filepath.Join(bin, "ssh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &GitSource{RepoURL: "ssh://git@git.example.com" + repo.bare, Ref: "v1", DeployKeySecret: "deploy-key"}
+	workspace, out, err := runCloneScript(t, source, "PATH="+bin+":"+os.Getenv("PATH"))
+	if err != nil {
+		t.Fatalf("clone failed : %v\n%s", err, out)
+	}
+	if content := readSrc(t, workspace, "site/index.html"); content != "v1" {
+		t.Errorf("site/index.html = %q, want v1", content)
+	}
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal("ssh wasn't used : ", err)
+	}
+	if !strings.Contains(string(args), "-i "+deployKeyPath+"/ssh-privatekey") {
+		t.Errorf("ssh wasn't given the deploy key : %s", args)
+	}
+	if !strings.Contains(string(args), "git@git.example.com") {
+		t.Errorf("ssh didn't connect to the repository's host : %s", args)
+	}
+
+	// the key is mounted from the secret, read only by its owner
+	volume := source.volume()
+	if volume == nil || volume.Secret.SecretName != "deploy-key" || *volume.Secret.DefaultMode != 0400 {
+		t.Errorf("volume = %+v", volume)
+	}
+	if (&GitSource{RepoURL: "https://example.com/site.git"}).volume() != nil {
+		t.Error("public repository has a deploy key volume")
+	}
+}
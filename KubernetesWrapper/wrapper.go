@@ -2,8 +2,9 @@ package kuberneteswrapper
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"os"
-	"regexp"
 	"time"
 
 	"github.com/Cloudbase-Project/static-site-hosting/constants"
@@ -14,21 +15,33 @@ import (
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
 type KubernetesWrapper struct {
-	KClient *kubernetes.Clientset
+	KClient kubernetes.Interface
 }
 
 type ImageBuilder struct {
 	Ctx       context.Context
 	Namespace string
+	Name      string // name of the builder pod. unique for every build
 	SiteId    string
+	BuildId   string
+	JobId     string // id of the build job in the worker queue
 	ImageName string
+	// Dockerfile to build the uploaded source with
+	Dockerfile string
+	// build step of the site, run in BuildImage on the source before kaniko. empty for none
+	BuildImage  string
+	BuildScript string
+	// clone this repository instead of fetching the upload of the job
+	Git *GitSource
 }
 
 type DeploymentOptions struct {
@@ -38,6 +51,7 @@ type DeploymentOptions struct {
 	DeploymentLabel map[string]string
 	ImageName       string
 	Replicas        int32
+	Resources       corev1.ResourceRequirements // requests and limits of the site's container
 }
 
 type ServiceOptions struct {
@@ -51,6 +65,7 @@ type UpdateOptions struct {
 	Ctx       context.Context
 	Namespace string
 	Name      string
+	ImageName string
 }
 
 type DeleteOptions struct {
@@ -59,7 +74,8 @@ type DeleteOptions struct {
 	Namespace string
 }
 
-func NewWrapper(client *kubernetes.Clientset) *KubernetesWrapper {
+// Wraps a client of the cluster, or a fake one from k8s.io/client-go/kubernetes/fake in tests
+func NewWrapper(client kubernetes.Interface) *KubernetesWrapper {
 	return &KubernetesWrapper{KClient: client}
 }
 
@@ -67,15 +83,24 @@ func (kw *KubernetesWrapper) BuildLabel(key string, value []string) (*labels.Req
 	return labels.NewRequirement(key, selection.Equals, value)
 }
 
+// Watch the image builder pod with the given name
 func (kw *KubernetesWrapper) GetImageBuilderWatcher(
 	ctx context.Context,
-	label string,
+	name string,
+	namespace string,
 ) (watch.Interface, error) {
 	return kw.KClient.CoreV1().
-		Pods(constants.Namespace).
+		Pods(namespace).
 		Watch(
 			ctx,
-			metav1.ListOptions{LabelSelector: label})
+			metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
+}
+
+// Delete the image builder pod with the given name
+func (kw *KubernetesWrapper) DeleteImageBuilder(options *DeleteOptions) error {
+	return kw.KClient.CoreV1().
+		Pods(options.Namespace).
+		Delete(options.Ctx, options.Name, metav1.DeleteOptions{})
 }
 
 func (kw *KubernetesWrapper) GetDeploymentWatcher(
@@ -91,50 +116,82 @@ func (kw *KubernetesWrapper) GetDeploymentWatcher(
 // Build an image for the given siteId and image name
 func (kw *KubernetesWrapper) CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod, error) {
 
-	var Dockerfile string
-	Dockerfile = constants.Dockerfile
-
-	m1 := regexp.MustCompile(`"`)
-	dockerfile := m1.ReplaceAllString(Dockerfile, `\"`)
-
 	REGISTRY := os.Getenv("REGISTRY")
 	BASE64_CREDENTIALS := os.Getenv("BASE64_CREDENTIALS")
 
+	// puts the source in /workspace/src
+	setup := corev1.Container{
+		Name:  "setup-kaniko",
+		Image: "yauritux/busybox-curl",
+		Command: []string{
+			"/bin/sh",
+			"-c",
+			"set -e\n" +
+				// the service runs in its own namespace
+				`wget -O /workspace/build.zip http://` + utils.ServiceHost("cloudbase-ssh-svc", constants.Namespace) + `:4000/worker/queue/` + ib.JobId + "\n" +
+				"mkdir -p /workspace/src && unzip -q /workspace/build.zip -d /workspace/src\n",
+		},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      "shared",
+			MountPath: "/workspace",
+		}, {
+			Name:      "dockerconfig",
+			MountPath: "/kaniko/.docker",
+		}},
+	}
+	volumes := []corev1.Volume{{
+		Name: "shared", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	},
+		{
+			Name: "dockerconfig", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		},
+	}
+	if ib.Git != nil {
+		setup.Image = "alpine/git"
+		setup.Command = []string{"/bin/sh", "-c", CloneScript("/workspace")}
+		setup.Env = ib.Git.env()
+		if volume := ib.Git.volume(); volume != nil {
+			volumes = append(volumes, *volume)
+			setup.VolumeMounts = append(setup.VolumeMounts, corev1.VolumeMount{
+				Name:      volume.Name,
+				MountPath: deployKeyPath,
+				ReadOnly:  true,
+			})
+		}
+	}
+	// the Dockerfile and the registry credentials for kaniko
+	setup.Command[2] += `printf '%s' "$DOCKERFILE" > /workspace/Dockerfile` +
+		` && echo -e "{\"auths\":{\"` + REGISTRY + `\":{\"auth\": \"` + BASE64_CREDENTIALS + `\" }}}" > /kaniko/.docker/config.json`
+	setup.Env = append(setup.Env, corev1.EnvVar{Name: "DOCKERFILE", Value: ib.Dockerfile})
+
+	initContainers := []corev1.Container{setup}
+	if ib.BuildImage != "" {
+		initContainers = append(initContainers, siteBuild(ib))
+	}
+
 	pod, err := kw.KClient.CoreV1().Pods(ib.Namespace).Create(ib.Ctx, &corev1.Pod{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Pod",
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "kaniko-worker",
+			Name: ib.Name,
 			Labels: map[string]string{
 				"builder": ib.SiteId, // the code id
+				"build":   ib.BuildId,
 			},
 		},
 		Spec: corev1.PodSpec{
-			InitContainers: []corev1.Container{{
-				Name:  "setup-kaniko",
-				Image: "yauritux/busybox-curl",
-				Command: []string{
-					"/bin/sh",
-					"-c",
-					`wget -O /workspace/build.zip http://cloudbase-ssh-svc:4000/worker/queue/ && ls -lash && echo -e "` + dockerfile + `" >> /workspace/Dockerfile && echo -e && echo -e "{\"auths\":{\"` + REGISTRY + `\":{\"auth\": \"` + BASE64_CREDENTIALS + `\" }}}" > /kaniko/.docker/config.json`,
-				},
-				VolumeMounts: []corev1.VolumeMount{{
-					Name:      "shared",
-					MountPath: "/workspace",
-				}, {
-					Name:      "dockerconfig",
-					MountPath: "/kaniko/.docker",
-				}},
-			}},
+			InitContainers: initContainers,
 			Containers: []corev1.Container{{
 				Name:  "kaniko-executor",
 				Image: "gcr.io/kaniko-project/executor:latest",
 				Args: []string{
 					"--dockerfile=/workspace/Dockerfile",
-					"--context=dir:///workspace",
+					"--context=dir:///workspace/src",
 					"--destination=" + ib.ImageName,
+					// the digest ends up in the container's termination message
+					"--digest-file=/dev/termination-log",
 				},
 				VolumeMounts: []corev1.VolumeMount{{
 					Name:      "shared",
@@ -145,27 +202,33 @@ func (kw *KubernetesWrapper) CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod,
 				}},
 			}},
 			RestartPolicy: corev1.RestartPolicyNever,
-			Volumes: []corev1.Volume{{
-				Name: "shared", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
-			},
-				{
-					Name: "dockerconfig", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
-				},
-			},
+			Volumes:       volumes,
+			// none of the containers talk to the api server
+			AutomountServiceAccountToken: &automountToken,
 		},
 	}, metav1.CreateOptions{})
 	return pod, err
 }
 
-func (kw *KubernetesWrapper) CreateNamespace(
-	ctx context.Context,
-	namespace string,
-) (*corev1.Namespace, error) {
-
-	return kw.KClient.CoreV1().
-		Namespaces().
-		Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, metav1.CreateOptions{})
-
+var automountToken = false
+
+/*
+Runs the site's build step, its install and build commands, on the source. These are the
+site's own scripts, so the container only gets the source: not the registry credentials kaniko
+pushes with, nor the Dockerfile it builds from, which are in other folders of the volume.
+*/
+func siteBuild(ib *ImageBuilder) corev1.Container {
+	return corev1.Container{
+		Name:       "site-build",
+		Image:      ib.BuildImage,
+		Command:    []string{"/bin/sh", "-c", ib.BuildScript},
+		WorkingDir: "/workspace/src",
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      "shared",
+			MountPath: "/workspace/src",
+			SubPath:   "src",
+		}},
+	}
 }
 
 func (kw *KubernetesWrapper) CreateDeployment(options *DeploymentOptions) (*v1.Deployment, error) {
@@ -183,22 +246,54 @@ func (kw *KubernetesWrapper) CreateDeployment(options *DeploymentOptions) (*v1.D
 						MatchLabels: options.DeploymentLabel,
 					},
 					Replicas: &options.Replicas, // TODO: Have to do more here
+					// pods that never get ready fail the rollout before the deploy timeout
+					ProgressDeadlineSeconds: &progressDeadline,
 					Template: corev1.PodTemplateSpec{
 						ObjectMeta: metav1.ObjectMeta{Labels: options.DeploymentLabel},
 						Spec: corev1.PodSpec{
 							RestartPolicy: corev1.RestartPolicyAlways,
-							Containers: []corev1.Container{{
-								Name:  options.SiteId,
-								Image: options.ImageName, // "image name from db", // should be ghcr.io/projectname/siteId:latest
-								Ports: []corev1.ContainerPort{{ContainerPort: 3000}},
-							}},
-							ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+							Containers: []corev1.Container{siteContainer(corev1.Container{
+								Name:      options.SiteId,
+								Image:     options.ImageName, // pinned to the digest of the build. ghcr.io/projectname/siteId@sha256:...
+								Resources: options.Resources,
+							})},
+							ImagePullSecrets: []corev1.LocalObjectReference{{Name: constants.RegistrySecret}},
 						},
 					},
 				},
 			}, metav1.CreateOptions{})
 }
 
+// seconds a rollout can go without progress before it fails
+var progressDeadline int32 = 300
+
+/*
+Sets the port and the probes of a site's container. The probes request the site's index on its
+port: the startup probe gives the server time to start, then pods only get traffic while the
+readiness probe passes and are restarted when the liveness probe fails.
+*/
+func siteContainer(container corev1.Container) corev1.Container {
+	probe := func(periodSeconds int32, failureThreshold int32) *corev1.Probe {
+		return &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: constants.SiteIndexPath,
+					Port: intstr.FromInt(constants.SitePort),
+				},
+			},
+			TimeoutSeconds:   2,
+			PeriodSeconds:    periodSeconds,
+			FailureThreshold: failureThreshold,
+		}
+	}
+
+	container.Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: constants.SitePort}}
+	container.StartupProbe = probe(2, 30)
+	container.ReadinessProbe = probe(5, 3)
+	container.LivenessProbe = probe(10, 3)
+	return container
+}
+
 func (kw *KubernetesWrapper) CreateService(options *ServiceOptions) (*corev1.Service, error) {
 
 	serviceName := utils.BuildServiceName(options.SiteId)
@@ -214,7 +309,7 @@ func (kw *KubernetesWrapper) CreateService(options *ServiceOptions) (*corev1.Ser
 				Selector: options.DeploymentLabel,
 				Type:     corev1.ServiceTypeClusterIP,
 				Ports: []corev1.ServicePort{
-					{Port: 4000, TargetPort: intstr.FromInt(4000)},
+					{Name: "http", Port: constants.SitePort, TargetPort: intstr.FromInt(constants.SitePort)},
 				},
 			},
 		}, metav1.CreateOptions{})
@@ -234,7 +329,26 @@ func (kw *KubernetesWrapper) DeleteService(options *DeleteOptions) error {
 		Delete(options.Ctx, options.Name, metav1.DeleteOptions{})
 }
 
-// updates the deployment label with current timestamp to trigger a redeploy
+// patches the image of the deployment's container. The container is named after the deployment
+func (kw *KubernetesWrapper) PatchDeploymentImage(options *UpdateOptions) (*v1.Deployment, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]string{{"name": options.Name, "image": options.ImageName}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kw.KClient.AppsV1().
+		Deployments(options.Namespace).
+		Patch(options.Ctx, options.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+}
+
+// updates the deployment's image and annotates it with current timestamp to trigger a redeploy
 func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 
 	deployment, err := kw.KClient.AppsV1().
@@ -245,6 +359,14 @@ func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 		return err
 	}
 
+	if options.ImageName != "" {
+		deployment.Spec.Template.Spec.Containers[0].Image = options.ImageName
+	}
+	// deployments created before the site's port and probes were set get them with the redeploy
+	deployment.Spec.Template.Spec.Containers[0] = siteContainer(deployment.Spec.Template.Spec.Containers[0])
+	if deployment.Spec.Template.ObjectMeta.Annotations == nil {
+		deployment.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
 	deployment.Spec.Template.ObjectMeta.Annotations["date"] = time.Now().String()
 
 	_, err = kw.KClient.AppsV1().
@@ -255,3 +377,77 @@ func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 	}
 	return nil
 }
+
+// Returns the logs of a container in a pod
+func (kw *KubernetesWrapper) GetPodLogs(
+	ctx context.Context,
+	namespace string,
+	podName string,
+	container string,
+) (string, error) {
+	logs, err := kw.KClient.CoreV1().
+		Pods(namespace).
+		GetLogs(podName, &corev1.PodLogOptions{Container: container}).
+		DoRaw(ctx)
+	return string(logs), err
+}
+
+// Stream the logs of a container of a pod. With follow the stream stays open until the
+// container exits. The caller closes the stream.
+func (kw *KubernetesWrapper) StreamPodLogs(
+	ctx context.Context,
+	namespace string,
+	podName string,
+	container string,
+	follow bool,
+) (io.ReadCloser, error) {
+	return kw.KClient.CoreV1().
+		Pods(namespace).
+		GetLogs(podName, &corev1.PodLogOptions{Container: container, Follow: follow}).
+		Stream(ctx)
+}
+
+func (kw *KubernetesWrapper) GetPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error) {
+	return kw.KClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// List the pods of a site's deployment
+func (kw *KubernetesWrapper) ListSitePods(ctx context.Context, namespace string, siteId string) ([]corev1.Pod, error) {
+	pods, err := kw.KClient.CoreV1().
+		Pods(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "app=" + siteId})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// List the image builder pods in the namespace
+func (kw *KubernetesWrapper) ListImageBuilders(ctx context.Context, namespace string) ([]corev1.Pod, error) {
+	pods, err := kw.KClient.CoreV1().
+		Pods(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "builder,build"})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// List the image builder pods of a build, one for each attempt
+func (kw *KubernetesWrapper) ListBuildPods(ctx context.Context, namespace string, buildId string) ([]corev1.Pod, error) {
+	pods, err := kw.KClient.CoreV1().
+		Pods(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "build=" + buildId})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func (kw *KubernetesWrapper) GetDeployment(ctx context.Context, namespace string, name string) (*v1.Deployment, error) {
+	return kw.KClient.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (kw *KubernetesWrapper) GetService(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	return kw.KClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,252 @@
+// Detects the format of uploaded sites and normalises them into the zip archive the build
+// pipeline expects.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	Zip     Format = "zip"
+	Tar     Format = "tar"
+	TarGzip Format = "tar.gz"
+	Unknown Format = ""
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported archive format. upload a .zip, .tar, .tar.gz or .tgz file, or the files of a folder")
+
+// Returned when an archive goes over its size or file count limit while it is unpacked
+type LimitError struct {
+	Problem Problem
+}
+
+func (e *LimitError) Error() string {
+	return e.Problem.Message
+}
+
+// The rejection as the report Validate would give
+func (e *LimitError) Report() *Report {
+	return &Report{Valid: false, Problems: []Problem{e.Problem}}
+}
+
+// Detects the format of an archive from its magic bytes
+func Detect(data []byte) Format {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return Zip
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return TarGzip
+	case isTar(data):
+		return Tar
+	}
+	return Unknown
+}
+
+// tar headers have "ustar" at offset 257. posix and gnu archives both do
+func isTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+/*
+Converts an archive into a zip. Zip archives are returned as they are, to be checked by Validate.
+
+Tars are unpacked against the size and file count limits, and a *LimitError is returned as soon
+as they are passed, so a small gzip bomb isn't inflated in full before it is rejected.
+*/
+func Normalize(data []byte, limits Limits) ([]byte, error) {
+	switch Detect(data) {
+	case Zip:
+		return data, nil
+	case Tar:
+		return fromTar(bytes.NewReader(data), limits)
+	case TarGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		// only gzipped tars are archives
+		var header [262]byte
+		n, _ := io.ReadFull(gz, header[:])
+		if !isTar(header[:n]) {
+			return nil, ErrUnsupportedFormat
+		}
+		return fromTar(io.MultiReader(bytes.NewReader(header[:n]), gz), limits)
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// Repacks the entries of a tar into a zip. Directories, regular files and symlinks are kept.
+func fromTar(r io.Reader, limits Limits) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	var files int
+	var totalSize int64
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+
+		var body io.Reader
+		switch header.Typeflag {
+		case tar.TypeDir:
+			name = strings.TrimSuffix(name, "/") + "/"
+		case tar.TypeReg:
+			body = tr
+		case tar.TypeSymlink:
+			body = strings.NewReader(header.Linkname)
+		default:
+			// devices, fifos and hard links have no place in a site
+			continue
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			files++
+			if limits.MaxFiles > 0 && files > limits.MaxFiles {
+				return nil, &LimitError{Problem{Rule: "file-count", Message: fmt.Sprintf("the archive has more than %v files", limits.MaxFiles)}}
+			}
+		}
+		// read one byte past what is left to tell a file that fits from one that doesn't
+		if header.Typeflag == tar.TypeReg && limits.MaxTotalSize > 0 {
+			body = io.LimitReader(tr, limits.MaxTotalSize-totalSize+1)
+		}
+
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: header.ModTime}
+		fh.SetMode(header.FileInfo().Mode())
+		if header.Typeflag == tar.TypeDir {
+			fh.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			n, err := io.Copy(w, body)
+			if err != nil {
+				return nil, err
+			}
+			if header.Typeflag == tar.TypeReg {
+				totalSize += n
+			}
+			if limits.MaxTotalSize > 0 && totalSize > limits.MaxTotalSize {
+				return nil, &LimitError{Problem{Rule: "total-size", Message: fmt.Sprintf("the files add up to more than %v bytes", limits.MaxTotalSize)}}
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Zips the files of a multipart upload. Browsers send the path of every file of an uploaded
+folder as its filename (eg: build/static/js/main.js), which the archive keeps.
+
+The files are added in order of their path so the same upload always gives the same archive.
+*/
+func FromFiles(files []*multipart.FileHeader) ([]byte, error) {
+	type entry struct {
+		name   string
+		header *multipart.FileHeader
+	}
+	entries := make([]entry, 0, len(files))
+	for _, fh := range files {
+		name := strings.TrimPrefix(path.Clean("/"+RelativePath(fh)), "/")
+		if name == "" {
+			continue
+		}
+		entries = append(entries, entry{name: name, header: fh})
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no files uploaded")
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		file, err := e.header.Open()
+		if err != nil {
+			return nil, err
+		}
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: time.Unix(0, 0).UTC()}
+		fh.SetMode(0644)
+		w, err := zw.CreateHeader(fh)
+		if err == nil {
+			_, err = io.Copy(w, file)
+		}
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the filename the client sent for a file with its directories. The Filename of a
+// multipart.FileHeader only has the base name.
+func RelativePath(fh *multipart.FileHeader) string {
+	_, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return strings.ReplaceAll(params["filename"], "\\", "/")
+	}
+	return fh.Filename
+}
+
+/*
+Turns the files posted for a site into a zip.
+
+A single file is an archive, whose format is detected from its content and which is normalised
+against limits. Several files, or a file inside a folder, are the files of an uploaded folder.
+Returns ErrUnsupportedFormat for a single file that isn't an archive.
+*/
+func FromUpload(files []*multipart.FileHeader, limits Limits) ([]byte, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files uploaded")
+	}
+	if len(files) > 1 || strings.Contains(strings.Trim(RelativePath(files[0]), "/"), "/") {
+		return FromFiles(files)
+	}
+
+	file, err := files[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return Normalize(data, limits)
+}
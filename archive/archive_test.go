@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	size     int64 // of a body of zeros, when body is empty
+	linkname string
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Linkname: e.linkname}
+		var body io.Reader
+		if e.typeflag == tar.TypeReg {
+			header.Size = int64(len(e.body))
+			body = bytes.NewReader([]byte(e.body))
+			if e.body == "" {
+				header.Size = e.size
+				body = io.LimitReader(zeros{}, e.size)
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if body != nil {
+			if _, err := io.Copy(tw, body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// names of the entries of a zip with the contents of its files
+func zipContents(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		contents[file.Name] = string(body)
+	}
+	return contents
+}
+
+func TestNormalize(t *testing.T) {
+	tarData := makeTar(t,
+		tarEntry{name: "./build/", typeflag: tar.TypeDir},
+		tarEntry{name: "./build/index.html", typeflag: tar.TypeReg, body: "<html></html>"},
+		tarEntry{name: "./build/home.html", typeflag: tar.TypeSymlink, linkname: "index.html"},
+		tarEntry{name: "./build/pipe", typeflag: tar.TypeFifo},
+	)
+	want := map[string]string{
+		"build/":           "",
+		"build/index.html": "<html></html>",
+		"build/home.html":  "index.html",
+	}
+	limits := Limits{MaxTotalSize: 1 << 20, MaxFiles: 10}
+
+	for name, data := range map[string][]byte{"tar": tarData, "tar.gz": gzipped(t, tarData)} {
+		t.Run(name, func(t *testing.T) {
+			zipped, err := Normalize(data, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := zipContents(t, zipped)
+			if len(got) != len(want) {
+				t.Fatalf("entries = %v, want %v", got, want)
+			}
+			for entry, body := range want {
+				if got[entry] != body {
+					t.Errorf("%v = %q, want %q", entry, got[entry], body)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeFormats(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create("index.html")
+	zw.Close()
+	zipped, err := Normalize(buf.Bytes(), Limits{})
+	if err != nil || !bytes.Equal(zipped, buf.Bytes()) {
+		t.Errorf("zip wasn't returned as it is : %v", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"unknown":         []byte("not an archive"),
+		"gzip, not a tar": gzipped(t, []byte("not an archive")),
+	} {
+		if _, err := Normalize(data, Limits{}); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("%v : err = %v, want ErrUnsupportedFormat", name, err)
+		}
+	}
+}
+
+func TestNormalizeLimits(t *testing.T) {
+	limits := Limits{MaxTotalSize: 1 << 20, MaxFiles: 2}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		rule    string
+	}{
+		{
+			name:    "within the limits",
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg, size: 1 << 19}, {name: "b", typeflag: tar.TypeReg, size: 1 << 19}},
+		},
+		{
+			// compresses to about 32KB but unpacks to 32MB
+			name:    "gzip bomb",
+			entries: []tarEntry{{name: "bomb", typeflag: tar.TypeReg, size: 32 << 20}},
+			rule:    "total-size",
+		},
+		{
+			name:    "files adding up over the size",
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg, size: 1 << 19}, {name: "b", typeflag: tar.TypeReg, size: 1<<19 + 1}},
+			rule:    "total-size",
+		},
+		{
+			name: "too many files",
+			entries: []tarEntry{
+				{name: "dir/", typeflag: tar.TypeDir},
+				{name: "dir/a", typeflag: tar.TypeReg, body: "a"},
+				{name: "dir/b", typeflag: tar.TypeSymlink, linkname: "a"},
+				{name: "dir/c", typeflag: tar.TypeReg, body: "c"},
+			},
+			rule: "file-count",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := gzipped(t, makeTar(t, test.entries...))
+			_, err := Normalize(data, limits)
+
+			var limitErr *LimitError
+			if test.rule == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("err = %v, want a LimitError", err)
+			}
+			if limitErr.Problem.Rule != test.rule {
+				t.Errorf("rule = %v, want %v", limitErr.Problem.Rule, test.rule)
+			}
+			if report := limitErr.Report(); report.Valid || len(report.Problems) != 1 {
+				t.Errorf("report = %+v", report)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// files smaller than this aren't checked for their compression ratio. small files of
+// repeated text compress very well
+const ratioCheckMinSize = 1 << 20
+
+// Limits an upload is validated against
+type Limits struct {
+	MaxTotalSize int64 // uncompressed bytes of all files
+	MaxFiles     int
+	// uncompressed size over compressed size of a single file
+	MaxCompressionRatio float64
+	// file that has to be in the archive, eg: build/index.html. not checked when empty
+	RequiredFile string
+}
+
+// A reason an upload was rejected
+type Problem struct {
+	Rule    string `json:"rule"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// The result of validating an upload
+type Report struct {
+	Valid     bool      `json:"valid"`
+	Files     int       `json:"files"`
+	TotalSize int64     `json:"totalSize"`
+	Problems  []Problem `json:"problems"`
+}
+
+func (r *Report) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
+
+func (r *Report) add(rule string, name string, format string, args ...interface{}) {
+	r.Valid = false
+	r.Problems = append(r.Problems, Problem{Rule: rule, Path: name, Message: fmt.Sprintf(format, args...)})
+}
+
+/*
+Inspects a zip before it is queued. Rejects absolute paths and paths with "..", symlinks that
+point outside the archive, files that decompress to much more than their compressed size, and
+archives over the size and file count limits.
+
+Files are decompressed to count their real size, since the sizes in the headers can lie.
+Stops reading once the size limit is passed.
+*/
+func Validate(data []byte, limits Limits) *Report {
+	report := &Report{Valid: true, Problems: []Problem{}}
+
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		report.add("format", "", "not a valid zip archive : %v", err)
+		return report
+	}
+
+	names := make(map[string]bool, len(reader.File))
+	for _, file := range reader.File {
+		name := file.Name
+		if !SafePath(name) {
+			report.add("path", name, "paths must be relative and stay inside the archive")
+			continue
+		}
+		names[path.Clean(name)] = true
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		report.Files++
+		if limits.MaxFiles > 0 && report.Files == limits.MaxFiles+1 {
+			report.add("file-count", "", "the archive has more than %v files", limits.MaxFiles)
+		}
+
+		if isSymlink(file) {
+			target, err := readAll(file, 4096)
+			if err != nil {
+				report.add("symlink", name, "unreadable symlink : %v", err)
+				continue
+			}
+			if !symlinkInside(name, string(target)) {
+				report.add("symlink", name, "symlink points outside the archive to %v", string(target))
+			}
+			continue
+		}
+
+		if report.TotalSize > limits.MaxTotalSize && limits.MaxTotalSize > 0 {
+			// already over the limit. the rest isn't decompressed
+			continue
+		}
+		budget := int64(-1)
+		if limits.MaxTotalSize > 0 {
+			budget = limits.MaxTotalSize - report.TotalSize + 1
+		}
+		size, err := uncompressedSize(file, budget)
+		report.TotalSize += size
+		if err != nil {
+			report.add("format", name, "corrupt file : %v", err)
+			continue
+		}
+		if limits.MaxTotalSize > 0 && report.TotalSize > limits.MaxTotalSize {
+			report.add("total-size", "", "the files add up to more than %v bytes", limits.MaxTotalSize)
+			continue
+		}
+		if limits.MaxCompressionRatio > 0 && size >= ratioCheckMinSize {
+			ratio := float64(size) / float64(file.CompressedSize64+1)
+			if ratio > limits.MaxCompressionRatio {
+				report.add("compression-ratio", name, "compressed %.0f times. the limit is %v", ratio, limits.MaxCompressionRatio)
+			}
+		}
+	}
+
+	if limits.RequiredFile != "" && !names[path.Clean(limits.RequiredFile)] {
+		report.add("index", limits.RequiredFile, "%v is missing", limits.RequiredFile)
+	}
+	return report
+}
+
+// Whether an archive path is relative, without any ".." segments
+func SafePath(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func isSymlink(file *zip.File) bool {
+	return file.Mode()&os.ModeSymlink != 0
+}
+
+// whether a symlink at name pointing to target resolves inside the archive
+func symlinkInside(name string, target string) bool {
+	if target == "" || strings.HasPrefix(target, "/") {
+		return false
+	}
+	resolved := path.Join(path.Dir(name), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// decompresses the file counting its bytes. stops after limit bytes when limit isn't -1
+func uncompressedSize(file *zip.File, limit int64) (int64, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if limit >= 0 {
+		r = io.LimitReader(rc, limit)
+	}
+	return io.Copy(ioutil.Discard, r)
+}
+
+func readAll(file *zip.File, limit int64) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, limit))
+}
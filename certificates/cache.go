@@ -0,0 +1,114 @@
+package certificates
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Stores the ACME cache in Postgres so every replica shares certificates and challenges.
+type PostgresCache struct {
+	db *gorm.DB
+}
+
+func NewPostgresCache(db *gorm.DB) *PostgresCache {
+	return &PostgresCache{db: db}
+}
+
+func (pc *PostgresCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var certificate models.Certificate
+	err := pc.db.WithContext(ctx).First(&certificate, "key = ?", key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return certificate.Data, nil
+}
+
+func (pc *PostgresCache) Put(ctx context.Context, key string, data []byte) error {
+	return pc.db.WithContext(ctx).
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&models.Certificate{Key: key, Data: data}).Error
+}
+
+func (pc *PostgresCache) Delete(ctx context.Context, key string) error {
+	return pc.db.WithContext(ctx).Delete(&models.Certificate{}, "key = ?", key).Error
+}
+
+// Stores the ACME cache as Kubernetes Secrets, one per key.
+type SecretCache struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+func NewSecretCache(client kubernetes.Interface, namespace string) *SecretCache {
+	return &SecretCache{client: client, namespace: namespace}
+}
+
+// annotation holding the original cache key, since secret names can't hold every key
+const secretKeyAnnotation = "cloudbase.dev/acme-cache-key"
+
+// returns the secret name of a cache key
+//
+// eg: www.example.com+rsa -> cloudbase-ssh-acme-www.example.com-rsa
+func secretName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '-'
+	}, key)
+	return "cloudbase-ssh-acme-" + strings.Trim(name, "-.")
+}
+
+func (sc *SecretCache) Get(ctx context.Context, key string) ([]byte, error) {
+	secret, err := sc.client.CoreV1().Secrets(sc.namespace).Get(ctx, secretName(key), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data["data"], nil
+}
+
+func (sc *SecretCache) Put(ctx context.Context, key string, data []byte) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName(key),
+			Labels:      map[string]string{"app": "cloudbase-ssh-acme"},
+			Annotations: map[string]string{secretKeyAnnotation: key},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"data": data},
+	}
+
+	secrets := sc.client.CoreV1().Secrets(sc.namespace)
+	_, err := secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	return err
+}
+
+func (sc *SecretCache) Delete(ctx context.Context, key string) error {
+	err := sc.client.CoreV1().Secrets(sc.namespace).Delete(ctx, secretName(key), metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
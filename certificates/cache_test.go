@@ -0,0 +1,114 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Checks a cache against what autocert expects of one
+func testCache(t *testing.T, cache autocert.Cache) {
+	t.Helper()
+	ctx := context.Background()
+	key := "www.example.com+rsa"
+
+	if _, err := cache.Get(ctx, key); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Fatalf("Get of a missing key : err = %v, want ErrCacheMiss", err)
+	}
+	if err := cache.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing key : %v", err)
+	}
+
+	if err := cache.Put(ctx, key, []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get(ctx, key); err != nil || !bytes.Equal(data, []byte("certificate")) {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+
+	// renewals overwrite the entry
+	if err := cache.Put(ctx, key, []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get(ctx, key); err != nil || !bytes.Equal(data, []byte("renewed")) {
+		t.Fatalf("Get after Put = %q, %v", data, err)
+	}
+
+	// the rsa and ecdsa certificates of a host are separate entries
+	if err := cache.Put(ctx, "www.example.com", []byte("ecdsa")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cache.Get(ctx, key); !bytes.Equal(data, []byte("renewed")) {
+		t.Fatalf("Put of another key changed %v to %q", key, data)
+	}
+
+	if err := cache.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, key); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Fatalf("Get after Delete : err = %v, want ErrCacheMiss", err)
+	}
+	if data, err := cache.Get(ctx, "www.example.com"); err != nil || !bytes.Equal(data, []byte("ecdsa")) {
+		t.Fatalf("Delete removed another key : %q, %v", data, err)
+	}
+}
+
+func TestSecretCache(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	testCache(t, NewSecretCache(client, "test"))
+
+	secret, err := client.CoreV1().Secrets("test").Get(context.Background(), "cloudbase-ssh-acme-www.example.com", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Annotations[secretKeyAnnotation] != "www.example.com" {
+		t.Errorf("key annotation = %q", secret.Annotations[secretKeyAnnotation])
+	}
+}
+
+func TestSecretName(t *testing.T) {
+	tests := map[string]string{
+		"www.example.com":     "cloudbase-ssh-acme-www.example.com",
+		"www.example.com+rsa": "cloudbase-ssh-acme-www.example.com-rsa",
+		"WWW.Example.com":     "cloudbase-ssh-acme-www.example.com",
+		"acme_account+key":    "cloudbase-ssh-acme-acme-account-key",
+		".token+":             "cloudbase-ssh-acme-token",
+	}
+	for key, want := range tests {
+		if name := secretName(key); name != want {
+			t.Errorf("secretName(%q) = %q, want %q", key, name, want)
+		}
+	}
+}
+
+// Runs against the database at TEST_POSTGRES_URI, which the test writes to
+func TestPostgresCache(t *testing.T) {
+	uri := os.Getenv("TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("TEST_POSTGRES_URI isn't set")
+	}
+	db, err := gorm.Open(postgres.Open(uri), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Certificate{}); err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Where("key IN ?", []string{"www.example.com", "www.example.com+rsa"}).Delete(&models.Certificate{})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	testCache(t, NewPostgresCache(db))
+}
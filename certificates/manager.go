@@ -0,0 +1,83 @@
+package certificates
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type ManagerOptions struct {
+	// ACME directory. Defaults to Let's Encrypt. eg: https://pebble:14000/dir for a local Pebble server
+	DirectoryURL string
+	// PEM file of extra CAs to trust when talking to the ACME server. Pebble uses a self signed one
+	CACertFile string
+	Email      string
+	Cache      autocert.Cache
+	// Returns an error for hosts that must not get a certificate
+	HostPolicy autocert.HostPolicy
+}
+
+// Creates an ACME manager that issues and renews certificates for custom domains. Its
+// HTTPHandler answers HTTP-01 challenges and its GetCertificate plugs into a tls.Config.
+func NewManager(options ManagerOptions) (*autocert.Manager, error) {
+	if options.Cache == nil {
+		return nil, errors.New("a certificate cache is required")
+	}
+
+	client := &acme.Client{DirectoryURL: options.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if options.CACertFile != "" {
+		pem, err := ioutil.ReadFile(options.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + options.CACertFile)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      options.Cache,
+		HostPolicy: options.HostPolicy,
+		Email:      options.Email,
+		Client:     client,
+		// renew 30 days before expiry
+		RenewBefore: 30 * 24 * time.Hour,
+	}, nil
+}
+
+// Host policy that only allows hosts the given lookup knows about
+func AllowHosts(allowed func(host string) (bool, error)) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		ok, err := allowed(host)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("certificates: " + host + " is not a verified domain")
+		}
+		return nil
+	}
+}
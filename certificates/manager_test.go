@@ -0,0 +1,146 @@
+package certificates
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewManager(t *testing.T) {
+	if _, err := NewManager(ManagerOptions{}); err == nil {
+		t.Error("manager without a cache was created")
+	}
+
+	cache := NewSecretCache(fake.NewSimpleClientset(), "test")
+	manager, err := NewManager(ManagerOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.Client.DirectoryURL == "" {
+		t.Error("manager has no ACME directory")
+	}
+
+	noCerts := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(noCerts, []byte("not a certificate"), 0644)
+	if _, err := NewManager(ManagerOptions{Cache: cache, CACertFile: noCerts}); err == nil {
+		t.Error("manager was created with a CA file without certificates")
+	}
+	if _, err := NewManager(ManagerOptions{Cache: cache, CACertFile: noCerts + ".missing"}); err == nil {
+		t.Error("manager was created with a missing CA file")
+	}
+}
+
+func TestAllowHosts(t *testing.T) {
+	lookupErr := errors.New("db down")
+	policy := AllowHosts(func(host string) (bool, error) {
+		if host == "broken.example.com" {
+			return false, lookupErr
+		}
+		return host == "www.example.com", nil
+	})
+
+	if err := policy(context.Background(), "www.example.com"); err != nil {
+		t.Errorf("verified domain refused : %v", err)
+	}
+	if err := policy(context.Background(), "other.example.com"); err == nil {
+		t.Error("unknown domain allowed")
+	}
+	if err := policy(context.Background(), "broken.example.com"); !errors.Is(err, lookupErr) {
+		t.Errorf("err = %v, want the lookup's error", err)
+	}
+}
+
+func getenv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+/*
+Issues a certificate from a Pebble server. Skipped unless PEBBLE_DIRECTORY_URL is set, eg:
+
+	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+	pebble-challtestsrv -defaultIPv4 127.0.0.1
+
+	PEBBLE_DIRECTORY_URL=https://localhost:14000/dir PEBBLE_CA_CERT=test/certs/pebble.minica.pem go test ./certificates
+
+Pebble has to reach this test's HTTP-01 handler at PEBBLE_DOMAIN (site.cloudbase.test by
+default) on PEBBLE_HTTP_PORT (5002 by default, the port Pebble validates on).
+*/
+func TestManagerPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL isn't set")
+	}
+	host := getenv("PEBBLE_DOMAIN", "site.cloudbase.test")
+	port := getenv("PEBBLE_HTTP_PORT", "5002")
+
+	cache := NewSecretCache(fake.NewSimpleClientset(), "test")
+	options := ManagerOptions{
+		DirectoryURL: directory,
+		CACertFile:   os.Getenv("PEBBLE_CA_CERT"),
+		Email:        "test@example.com",
+		Cache:        cache,
+		HostPolicy:   AllowHosts(func(h string) (bool, error) { return h == host, nil }),
+	}
+	manager, err := NewManager(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// answer the HTTP-01 challenges
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: manager.HTTPHandler(nil)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:       host,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	cert, err := manager.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname(host); err != nil {
+		t.Errorf("certificate isn't for %v : %v", host, err)
+	}
+
+	// the certificate is stored for the other replicas
+	if data, err := cache.Get(context.Background(), host); err != nil || len(data) == 0 {
+		t.Fatalf("certificate wasn't cached : %v", err)
+	}
+	options.DirectoryURL = "http://127.0.0.1:1/dir"
+	replica, err := NewManager(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := replica.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("replica didn't serve the cached certificate : %v", err)
+	}
+	if cached.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Error("replica issued another certificate")
+	}
+
+	// hosts that aren't verified domains don't get one
+	other := *hello
+	other.ServerName = "other." + host
+	if _, err := manager.GetCertificate(&other); err == nil {
+		t.Error("certificate issued for a host that isn't allowed")
+	}
+}
@@ -9,11 +9,22 @@ const (
 
 const (
 	// NodejsDockerfile  = "FROM node:alpine \n workdir /app \n copy package.json . \n run npm install \n copy . . \n cmd [\"node\", \"index.js\"]"
-	Dockerfile        = "FROM node:alpine \n WORKDIR /app \n RUN yarn global add serve \n COPY . . \n RUN echo $(ls -lash /app/) \n RUN unzip build.zip \n CMD [\"serve\", \"-p\", \"4000\", \"-s\", \"./build\"]"
 	NodejsPackageJSON = "{\r\n  \"name\": \"user-code-worker\",\r\n  \"version\": \"1.0.0\",\r\n  \"main\": \"index.js\",\r\n  \"license\": \"MIT\",\r\n  \"dependencies\": {\r\n    \"express\": \"^4.17.1\"\r\n  }\r\n}\r\n"
 	// Namespace           = "serverless"
-	Namespace           = "default"
+	// namespace the service runs in, with its secrets. sites of projects get their own namespace
+	Namespace = "default"
+	// pull secret of the site images, copied to the namespace of every project
+	RegistrySecret      = "regcred"
 	RegistryCredentials = "qweqwe"
+	// label with the id of a project's config, on its namespace and on the deploy keys it can use
+	ConfigLabel = "cloudbase.dev/config"
+)
+
+const (
+	// port sites are served on by their image, container and service
+	SitePort = 4000
+	// path the probes of a site's container request. serve answers it with the site's index.html
+	SiteIndexPath = "/"
 )
 
 type BuildStatus string
@@ -38,8 +49,60 @@ const (
 type LastAction string
 
 const (
-	UpdateAction LastAction = "Update"
-	DeployAction LastAction = "Deploy"
-	BuildAction  LastAction = "Build"
-	CreateAction LastAction = "Create"
+	UpdateAction   LastAction = "Update"
+	DeployAction   LastAction = "Deploy"
+	BuildAction    LastAction = "Build"
+	CreateAction   LastAction = "Create"
+	RedeployAction LastAction = "Redeploy"
+	RollbackAction LastAction = "Rollback"
+)
+
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"
+	JobClaimed JobState = "claimed"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+type HostingMode string
+
+const (
+	// built into an image and served by its own deployment
+	ContainerHosting HostingMode = "Container"
+	// extracted into the blob store and served by the proxy
+	StorageHosting HostingMode = "Storage"
+)
+
+type SourceType string
+
+const (
+	// a zip uploaded to the service
+	ArchiveSource SourceType = "archive"
+	// cloned from a git repository by the image builder
+	GitSource SourceType = "git"
+)
+
+// git providers that can send push webhooks
+const (
+	GitHubProvider = "github"
+	GitLabProvider = "gitlab"
+	GiteaProvider  = "gitea"
+)
+
+// uploads with a file compressed more than this many times are rejected as zip bombs
+const MaxCompressionRatio = 100
+
+// directory inside the uploaded archive that holds the built site
+const DefaultOutputDir = "build"
+
+// preset of sites that don't pick one. the upload is an already built site
+const DefaultPreset = "static"
+
+// domains are verified with a TXT record "cloudbase-verify=<token>" at _cloudbase-verify.<hostname>
+const (
+	DomainVerificationPrefix = "_cloudbase-verify."
+	DomainVerificationKey    = "cloudbase-verify="
 )
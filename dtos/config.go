@@ -3,4 +3,11 @@ package dtos
 type CreateConfigDTO struct {
 	Owner     string `valid:"required;type(string)"`
 	ProjectId string `valid:"required;type(string)"`
+	// limits of the project's plan. the defaults when empty
+	MaxReplicas int    `valid:"optional"`
+	MaxCPU      string `valid:"optional"`
+	MaxMemory   string `valid:"optional"`
+	QuotaPods   int    `valid:"optional"`
+	QuotaCPU    string `valid:"optional"`
+	QuotaMemory string `valid:"optional"`
 }
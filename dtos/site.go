@@ -12,3 +12,69 @@ type PostCodeDTO struct {
 type UpdateCodeDTO struct {
 	Code string `valid:"required;type(string)"`
 }
+
+// Rollback to the build of a previous deployment, or to a build directly
+type RollbackDTO struct {
+	DeploymentId string `valid:"uuid,optional"`
+	BuildId      string `valid:"uuid,optional"`
+}
+
+type CreateSiteDTO struct {
+	HostingMode     string `valid:"in(Container|Storage),optional"`
+	Preset          string `valid:"optional"`
+	BuildCommand    string `valid:"optional"`
+	OutputDir       string `valid:"optional"`
+	SourceType      string `valid:"in(archive|git),optional"`
+	RepoURL         string `valid:"optional"`
+	Ref             string `valid:"optional"`
+	Subdirectory    string `valid:"optional"`
+	DeployKeySecret string `valid:"optional"`
+}
+
+// Change how a site is built. Empty fields are left as they are.
+type UpdateSiteDTO struct {
+	Preset          string `valid:"optional"`
+	BuildCommand    string `valid:"optional"`
+	OutputDir       string `valid:"optional"`
+	RepoURL         string `valid:"optional"`
+	Ref             string `valid:"optional"`
+	Subdirectory    string `valid:"optional"`
+	DeployKeySecret string `valid:"optional"`
+}
+
+// Scaling and resources of a site's deployment. Empty fields are left as they are.
+type ScalingDTO struct {
+	MinReplicas   int    `valid:"optional"`
+	MaxReplicas   int    `valid:"optional"`
+	TargetCPU     int    `valid:"range(1|100),optional"`
+	CPURequest    string `valid:"optional"`
+	CPULimit      string `valid:"optional"`
+	MemoryRequest string `valid:"optional"`
+	MemoryLimit   string `valid:"optional"`
+}
+
+// Push-to-deploy settings of a git site
+type WebhookDTO struct {
+	Branch     string `valid:"required"`
+	AutoDeploy bool   `valid:"optional"`
+}
+
+// Start a resumable upload. Checksum is the sha256 of the whole archive in hex
+type CreateUploadDTO struct {
+	Length   int64  `valid:"required"`
+	Checksum string `valid:"hexadecimal,stringlength(64|64),required"`
+}
+
+// Checksum overrides the one the upload was created with
+type CommitUploadDTO struct {
+	Checksum string `valid:"hexadecimal,stringlength(64|64),optional"`
+}
+
+// An incremental deploy. Files maps every path of the site to the sha256 of its content
+type CreateManifestDTO struct {
+	Files map[string]string `valid:"required"`
+}
+
+type CreateDomainDTO struct {
+	Hostname string `valid:"dns,required"`
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type BuildHandler struct {
+	l       *log.Logger
+	service *services.BuildService
+	sites   *services.SiteService
+}
+
+func NewBuildHandler(
+	l *log.Logger,
+	s *services.BuildService,
+	ss *services.SiteService,
+) *BuildHandler {
+	return &BuildHandler{l: l, service: s, sites: ss}
+}
+
+// Get the build history of a site
+func (b *BuildHandler) ListBuilds(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := b.sites.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
+	builds, err := b.service.GetAllBuilds(site.ID)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	err = builds.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// Get a build of a site along with its logs
+func (b *BuildHandler) GetBuild(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := b.sites.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
+	build, err := b.service.GetBuild(site.ID, vars["buildId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Build not found", 404)
+			return
+		}
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	err = build.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+/*
+Get the logs of a build as plain text.
+
+With follow=true the logs are streamed over SSE instead. A running build's logs are followed
+until it finishes, with `log` events for lines and `phase` events for changes of the build's
+phase. An `end` event with the build's status closes the stream.
+*/
+func (b *BuildHandler) GetBuildLogs(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := b.sites.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
+	build, err := b.service.GetBuild(site.ID, vars["buildId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Build not found", 404)
+			return
+		}
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(rw, build.Logs)
+		return
+	}
+
+	rw = utils.SetSSEHeaders(rw)
+	history, events, stop, live := b.service.FollowLogs(build.ID)
+	defer stop()
+
+	if !live {
+		// the build is over, replay what was kept
+		for _, line := range strings.Split(strings.TrimSuffix(build.Logs, "\n"), "\n") {
+			if line != "" {
+				writeLogEvent(rw, services.LogEvent{Type: services.LogLine, Data: line})
+			}
+		}
+		writeSSE(rw, "end", build.Status)
+		return
+	}
+
+	for _, event := range history {
+		writeLogEvent(rw, event)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// re-read the build for the status it finished with
+				if finished, err := b.service.GetBuild(site.ID, build.ID.String()); err == nil {
+					build = finished
+				}
+				writeSSE(rw, "end", build.Status)
+				return
+			}
+			writeLogEvent(rw, event)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Writes a build log event to an SSE stream
+func writeLogEvent(rw http.ResponseWriter, event services.LogEvent) {
+	writeSSE(rw, event.Type, event.Data)
+}
+
+// Writes an SSE event of a type and flushes it
+func writeSSE(rw http.ResponseWriter, event string, data string) {
+	fmt.Fprintf(rw, "event: %v\ndata: %v\n\n", event, data)
+	if fl, ok := rw.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
@@ -5,23 +5,27 @@ import (
 	"net/http"
 	"os"
 
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
 	"github.com/Cloudbase-Project/static-site-hosting/dtos"
 	"github.com/Cloudbase-Project/static-site-hosting/services"
 	"github.com/Cloudbase-Project/static-site-hosting/utils"
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
+	"k8s.io/client-go/kubernetes"
 )
 
 type ConfigHandler struct {
 	l       *log.Logger
 	service *services.ConfigService
+	kw      kuberneteswrapper.Interface
 }
 
 func NewConfigHandler(
+	client kubernetes.Interface,
 	l *log.Logger,
 	s *services.ConfigService,
 ) *ConfigHandler {
-	return &ConfigHandler{l: l, service: s}
+	return &ConfigHandler{l: l, service: s, kw: kuberneteswrapper.NewWrapper(client)}
 }
 
 func (c *ConfigHandler) CreateConfig(rw http.ResponseWriter, r *http.Request) {
@@ -36,6 +40,30 @@ func (c *ConfigHandler) CreateConfig(rw http.ResponseWriter, r *http.Request) {
 	config.ToJSON(rw)
 }
 
+// Remove a project from static site hosting. Deletes its sites and the namespace their builds and
+// deployments run in.
+func (c *ConfigHandler) DeleteConfig(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	projectId := mux.Vars(r)["projectId"]
+
+	config, err := c.service.GetConfig(projectId, ownerId)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if config == nil {
+		http.Error(rw, "Project not found", 404)
+		return
+	}
+
+	if err := c.service.DeleteConfig(c.kw, r.Context(), config); err != nil {
+		c.l.Print("error deleting project ", projectId, " : ", err)
+		http.Error(rw, "Error deleting the project", 500)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
 func (c *ConfigHandler) ToggleService(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Cloudbase-Project/static-site-hosting/dtos"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type DomainHandler struct {
+	l       *log.Logger
+	service *services.DomainService
+	sites   *services.SiteService
+	proxy   *services.ProxyService
+}
+
+func NewDomainHandler(
+	l *log.Logger,
+	s *services.DomainService,
+	ss *services.SiteService,
+	ps *services.ProxyService,
+) *DomainHandler {
+	return &DomainHandler{l: l, service: s, sites: ss, proxy: ps}
+}
+
+// Attach a custom domain to a site. The response has the TXT record to create for verifying it.
+func (d *DomainHandler) AddDomain(rw http.ResponseWriter, r *http.Request) {
+	site, ok := d.getSite(rw, r)
+	if !ok {
+		return
+	}
+
+	var data dtos.CreateDomainDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	domain, err := d.service.CreateDomain(site.ID, data.Hostname)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrDomainTaken), errors.Is(err, services.ErrDomainExists):
+			http.Error(rw, err.Error(), http.StatusConflict)
+		case errors.Is(err, services.ErrDomainInvalidInput), errors.Is(err, services.ErrDomainReserved):
+			http.Error(rw, err.Error(), 400)
+		default:
+			http.Error(rw, "DB error", 500)
+		}
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+	domain.ToJSON(rw)
+}
+
+func (d *DomainHandler) ListDomains(rw http.ResponseWriter, r *http.Request) {
+	site, ok := d.getSite(rw, r)
+	if !ok {
+		return
+	}
+
+	domains, err := d.service.GetAllDomains(site.ID)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	err = domains.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// Check the domain's TXT record. Once verified the domain serves the site.
+func (d *DomainHandler) VerifyDomain(rw http.ResponseWriter, r *http.Request) {
+	domain, ok := d.getDomain(rw, r)
+	if !ok {
+		return
+	}
+
+	if !domain.Verified {
+		err := d.service.VerifyDomain(r.Context(), domain)
+		if errors.Is(err, services.ErrDomainNotVerified) {
+			http.Error(rw, "TXT record not found. Add a TXT record for _cloudbase-verify."+domain.Hostname, 400)
+			return
+		}
+		if errors.Is(err, services.ErrDomainTaken) {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+		d.proxy.ForgetHost(domain.Hostname)
+	}
+
+	domain.ToJSON(rw)
+}
+
+func (d *DomainHandler) RemoveDomain(rw http.ResponseWriter, r *http.Request) {
+	domain, ok := d.getDomain(rw, r)
+	if !ok {
+		return
+	}
+
+	if err := d.service.DeleteDomain(domain); err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	d.proxy.ForgetHost(domain.Hostname)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Gets the site in the route params. Writes an error response if it isn't found.
+func (d *DomainHandler) getSite(rw http.ResponseWriter, r *http.Request) (*models.Site, bool) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := d.sites.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return nil, false
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return nil, false
+	}
+	return site, true
+}
+
+// Gets the domain in the route params. Writes an error response if it isn't found.
+func (d *DomainHandler) getDomain(rw http.ResponseWriter, r *http.Request) (*models.Domain, bool) {
+	site, ok := d.getSite(rw, r)
+	if !ok {
+		return nil, false
+	}
+
+	domain, err := d.service.GetDomain(site.ID, mux.Vars(r)["domainId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Domain not found", 404)
+			return nil, false
+		}
+		http.Error(rw, err.Error(), 500)
+		return nil, false
+	}
+	return domain, true
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Responds to a request that started a job with 202 and the job. Its status is at the
+// Location of the response.
+func acceptJob(rw http.ResponseWriter, r *http.Request, job *models.Job) {
+	vars := mux.Vars(r)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Location", "/site/"+vars["projectId"]+"/"+vars["siteId"]+"/jobs/"+job.ID.String())
+	rw.WriteHeader(http.StatusAccepted)
+	job.ToJSON(rw)
+}
+
+// Get the status of a build or deploy job of a site
+func (f *SiteHandler) GetJob(rw http.ResponseWriter, r *http.Request) {
+	job, ok := f.getJob(rw, r)
+	if !ok {
+		return
+	}
+
+	err := job.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+/*
+Stream the progress of a job over SSE. `status` events carry the job's state, `message`
+events its progress, and the `log` and `phase` events of a build job's logs are passed on as
+they happen. An `end` event with the job's final state closes the stream.
+*/
+func (f *SiteHandler) StreamJob(rw http.ResponseWriter, r *http.Request) {
+	job, ok := f.getJob(rw, r)
+	if !ok {
+		return
+	}
+
+	rw = utils.SetSSEHeaders(rw)
+	history, events, stop, live := f.jobs.FollowJob(job.ID)
+	defer stop()
+
+	if !live {
+		writeSSE(rw, services.LogStatus, job.State)
+		writeSSE(rw, "end", job.State)
+		return
+	}
+
+	for _, event := range history {
+		writeLogEvent(rw, event)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// re-read the job for the state it finished with
+				if finished, err := f.jobs.GetJob(job.SiteID, job.ID.String()); err == nil {
+					job = finished
+				}
+				writeSSE(rw, "end", job.State)
+				return
+			}
+			writeLogEvent(rw, event)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Gets the job in the route params. Writes an error response if it isn't found.
+func (f *SiteHandler) getJob(rw http.ResponseWriter, r *http.Request) (*models.Job, bool) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return nil, false
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return nil, false
+	}
+
+	job, err := f.jobs.GetJob(site.ID, vars["jobId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Job not found", 404)
+			return nil, false
+		}
+		http.Error(rw, err.Error(), 500)
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Cloudbase-Project/static-site-hosting/archive"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/dtos"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// A manifest with the hashes whose content still has to be uploaded
+type manifestResponse struct {
+	ID      string   `json:"id"`
+	Missing []string `json:"missing"`
+}
+
+/*
+Start an incremental deploy. The body maps every path of the new version of the site to the
+sha256 of its content. The response lists the hashes the project's store doesn't have, which
+are then uploaded one by one before the manifest is finalized into a build.
+*/
+func (f *SiteHandler) CreateManifest(rw http.ResponseWriter, r *http.Request) {
+	site, ok := f.getUploadSite(rw, r)
+	if !ok {
+		return
+	}
+
+	var data dtos.CreateManifestDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if config.MaxUploadFiles > 0 && len(data.Files) > config.MaxUploadFiles {
+		http.Error(rw, "The manifest has more files than the project's quota", http.StatusRequestEntityTooLarge)
+		return
+	}
+	for path, hash := range data.Files {
+		if !archive.SafePath(path) || strings.HasSuffix(path, "/") {
+			http.Error(rw, "Invalid path "+path, 400)
+			return
+		}
+		if !validContentHash(hash) {
+			http.Error(rw, "Invalid sha256 for "+path, 400)
+			return
+		}
+	}
+
+	manifest, err := f.manifests.CreateManifest(site.ID, data.Files)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	missing, err := f.manifests.Missing(r.Context(), config.ID, manifest)
+	if err != nil {
+		f.l.Print("error checking the content store : ", err)
+		http.Error(rw, "Error checking stored files", 500)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(manifestResponse{ID: manifest.ID.String(), Missing: missing})
+}
+
+// Upload the content of a file of a manifest. The body is the raw content, whose sha256 has to
+// be the hash in the route params.
+func (f *SiteHandler) PutManifestContent(rw http.ResponseWriter, r *http.Request) {
+	manifest, site, ok := f.getManifest(rw, r)
+	if !ok {
+		return
+	}
+	hash := mux.Vars(r)["hash"]
+	if !validContentHash(hash) {
+		http.Error(rw, "Invalid sha256", 400)
+		return
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	err = f.manifests.PutContent(r.Context(), config.ID, manifest, hash, r.Body, config.MaxUploadSize)
+	switch {
+	case errors.Is(err, services.ErrContentHashMismatch):
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, services.ErrContentNotInManifest):
+		http.Error(rw, err.Error(), 404)
+		return
+	case errors.Is(err, services.ErrManifestFinalized):
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		f.l.Print("error storing content : ", err)
+		http.Error(rw, "Error storing file", 500)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Assemble the files of a manifest into a new version of the site and build it like an upload.
+// Errors with the missing hashes if any content isn't uploaded yet.
+func (f *SiteHandler) FinalizeManifest(rw http.ResponseWriter, r *http.Request) {
+	manifest, site, ok := f.getManifest(rw, r)
+	if !ok {
+		return
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	// claimed before it is built, so a manifest finalized twice at once is built once
+	buildId := uuid.New()
+	err = f.manifests.Claim(manifest, buildId)
+	if errors.Is(err, services.ErrManifestFinalized) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			if err := f.manifests.Release(manifest, buildId); err != nil {
+				f.l.Print("error releasing manifest ", manifest.ID, " : ", err)
+			}
+		}
+	}()
+
+	missing, err := f.manifests.Missing(r.Context(), config.ID, manifest)
+	if err != nil {
+		f.l.Print("error checking the content store : ", err)
+		http.Error(rw, "Error checking stored files", 500)
+		return
+	}
+	if len(missing) > 0 {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(manifestResponse{ID: manifest.ID.String(), Missing: missing})
+		return
+	}
+
+	fileBytes, err := f.manifests.Assemble(r.Context(), config.ID, manifest)
+	if err != nil {
+		f.l.Print("error assembling manifest : ", err)
+		http.Error(rw, "Error assembling site", 500)
+		return
+	}
+
+	build, job, ok := f.enqueueUpload(rw, site, config, fileBytes, buildId)
+	if !ok {
+		return
+	}
+	queued = true
+
+	f.startBuild(rw, r, site, build, job, constants.BuildAction)
+}
+
+// Gets the manifest in the route params with its site. Writes an error response if it isn't found.
+func (f *SiteHandler) getManifest(rw http.ResponseWriter, r *http.Request) (*models.Manifest, *models.Site, bool) {
+	site, ok := f.getUploadSite(rw, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	manifest, err := f.manifests.GetManifest(site.ID, mux.Vars(r)["manifestId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Manifest not found", 404)
+			return nil, nil, false
+		}
+		http.Error(rw, err.Error(), 500)
+		return nil, nil, false
+	}
+	return manifest, site, true
+}
+
+// a lowercase hex sha256
+func validContentHash(hash string) bool {
+	if len(hash) != 64 || strings.ToLower(hash) != hash {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// An error page shown to visitors of a site
+type page struct {
+	Status     int
+	RetryAfter int // seconds. also refreshes the page
+	Title      string
+	Message    string
+}
+
+var (
+	notFoundPage = page{
+		Status:  http.StatusNotFound,
+		Title:   "Site not found",
+		Message: "There is no site at this address, or it hasn't been deployed yet.",
+	}
+	buildingPage = page{
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: 30,
+		Title:      "This site is being built",
+		Message:    "A new version of this site is being built. This page will refresh once it is ready.",
+	}
+	deployingPage = page{
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: 10,
+		Title:      "This site is being deployed",
+		Message:    "This site is starting up. This page will refresh once it is ready.",
+	}
+	wakingPage = page{
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: 5,
+		Title:      "This site is waking up",
+		Message:    "This site was asleep after a while without visitors and is starting up. This page will refresh once it is ready.",
+	}
+	deploymentFailedPage = page{
+		Status:  http.StatusServiceUnavailable,
+		Title:   "This site failed to deploy",
+		Message: "The latest deployment of this site failed. If you own this site, check its deployment in the Cloudbase dashboard.",
+	}
+	unavailablePage = page{
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: 30,
+		Title:      "This site is temporarily unavailable",
+		Message:    "This site isn't responding right now. Please try again in a little while.",
+	}
+)
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .RetryAfter}}<meta http-equiv="refresh" content="{{.RetryAfter}}">{{end}}
+<title>{{.Title}} | Cloudbase</title>
+<style>
+body{margin:0;min-height:100vh;display:flex;align-items:center;justify-content:center;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#0f172a;color:#e2e8f0}
+main{max-width:32rem;padding:2rem;text-align:center}
+h1{font-size:1.5rem;margin:0 0 1rem}
+p{line-height:1.5;color:#94a3b8}
+footer{margin-top:2rem;font-size:.8rem;color:#64748b}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<footer>Hosted on Cloudbase</footer>
+</main>
+</body>
+</html>
+`))
+
+// Writes the page with its status code
+func renderPage(rw http.ResponseWriter, p page) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if p.RetryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(p.RetryAfter))
+	}
+	rw.WriteHeader(p.Status)
+	pageTemplate.Execute(rw, p)
+}
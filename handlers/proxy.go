@@ -1,27 +1,90 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
+	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
 	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/storage"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 type ProxyHandler struct {
 	l       *log.Logger
 	service *services.ProxyService
+	storage *services.StorageService
+	proxy   *httputil.ReverseProxy
+
+	idle     *services.IdleScaler
+	wakeWait time.Duration
+
+	mu       sync.Mutex
+	requests map[uuid.UUID]time.Time // last request of each site since the last flush
+}
+
+// Timeouts and pooling of the connections to the sites' services
+type ProxyOptions struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	// how long a request to a sleeping site waits for it to wake up before a loading page is shown
+	WakeWait time.Duration
 }
 
 func NewProxyHandler(
 	l *log.Logger,
 	s *services.ProxyService,
+	sts *services.StorageService,
+	idle *services.IdleScaler,
+	options ProxyOptions,
 ) *ProxyHandler {
-	return &ProxyHandler{l: l, service: s}
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   options.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          options.MaxIdleConnsPerHost * 16,
+		MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+		IdleConnTimeout:       options.IdleConnTimeout,
+		ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	p := &ProxyHandler{
+		l:        l,
+		service:  s,
+		storage:  sts,
+		idle:     idle,
+		wakeWait: options.WakeWait,
+		requests: map[uuid.UUID]time.Time{},
+	}
+	p.proxy = &httputil.ReverseProxy{
+		// the request url is rewritten to the upstream before it reaches the proxy
+		Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// stop the transport from adding its own user agent
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:     transport,
+		FlushInterval: 100 * time.Millisecond,
+		ErrorHandler:  p.upstreamError,
+	}
+	return p
 }
 
 func (p *ProxyHandler) ProxyRequest(rw http.ResponseWriter, r *http.Request) {
@@ -30,22 +93,189 @@ func (p *ProxyHandler) ProxyRequest(rw http.ResponseWriter, r *http.Request) {
 
 	siteId := vars["siteId"]
 
-	urlString := r.URL.String()
-	x := strings.Split(urlString, "/serve/"+siteId)
+	site, err := p.service.VerifySite(siteId)
+	if err != nil {
+		renderPage(rw, notFoundPage)
+		return
+	}
+
+	p.serveSite(rw, r, site, strings.TrimPrefix(r.URL.Path, "/serve/"+siteId), "/static-site-hosting"+r.URL.Path)
+}
+
+// Routes requests for verified custom domains to their site at the root path. Other requests
+// go to next.
+func (p *ProxyHandler) HostRouter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		site, err := p.service.SiteForHost(r.Host)
+		if err != nil {
+			p.l.Print("error looking up host ", r.Host, " : ", err)
+		}
+		if site == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		p.serveSite(rw, r, site, r.URL.Path, r.URL.Path)
+	})
+}
+
+// Serves a request for a site. filePath is the path within the site and upstreamPath is the
+// path the site's service expects.
+func (p *ProxyHandler) serveSite(
+	rw http.ResponseWriter,
+	r *http.Request,
+	site *models.Site,
+	filePath string,
+	upstreamPath string,
+) {
+	if unavailable, ok := sitePage(site); ok {
+		renderPage(rw, unavailable)
+		return
+	}
+
+	if site.HostingMode == string(constants.StorageHosting) {
+		p.serveFromStorage(rw, r, site, filePath)
+		return
+	}
+
+	if p.idle.Enabled() {
+		p.recordRequest(site.ID)
+	}
+	if site.Sleeping && !p.wakeSite(rw, r, site) {
+		return
+	}
+	p.serveFromService(rw, r, site, upstreamPath)
+}
+
+func (p *ProxyHandler) recordRequest(siteId uuid.UUID) {
+	p.mu.Lock()
+	p.requests[siteId] = time.Now()
+	p.mu.Unlock()
+}
+
+// Saves the last request of the sites requested since the last flush
+func (p *ProxyHandler) FlushRequests() error {
+	p.mu.Lock()
+	requests := p.requests
+	p.requests = map[uuid.UUID]time.Time{}
+	p.mu.Unlock()
+
+	return p.idle.RecordRequests(requests)
+}
 
-	siteURL := "http://cloudbase-ssh-" + siteId + "-svc:4000/static-site-hosting/serve/" + siteId + x[1]
+/*
+Wakes a sleeping site and holds the request until it is awake. Shows a loading page if that
+takes longer than wakeWait, the site keeps waking up and the page refreshes to it. Returns false
+if the request was answered.
+*/
+func (p *ProxyHandler) wakeSite(rw http.ResponseWriter, r *http.Request, site *models.Site) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), p.wakeWait)
+	defer cancel()
 
-	finalURL, err := url.Parse(siteURL)
+	err := p.idle.Wake(ctx, site)
+	if err == nil {
+		return true
+	}
+	if r.Context().Err() != nil {
+		// client went away
+		return false
+	}
+	if ctx.Err() != nil {
+		renderPage(rw, wakingPage)
+		return false
+	}
+	renderPage(rw, unavailablePage)
+	return false
+}
+
+// Returns the page to show instead of the site when it has nothing to serve
+func sitePage(site *models.Site) (page, bool) {
+	switch constants.DeploymentStatus(site.DeployStatus) {
+	case constants.Deployed, constants.RedeployRequired:
+		// a deployment is live
+		return page{}, false
+	case constants.Deploying:
+		return deployingPage, true
+	case constants.DeploymentFailed:
+		return deploymentFailedPage, true
+	}
+	if site.BuildStatus == string(constants.Building) {
+		return buildingPage, true
+	}
+	return notFoundPage, true
+}
+
+// Streams the request to the site's service and the response back, as is.
+func (p *ProxyHandler) serveFromService(rw http.ResponseWriter, r *http.Request, site *models.Site, upstreamPath string) {
+	out := r.Clone(r.Context())
+
+	out.URL.Scheme = "http"
+	out.URL.Host = fmt.Sprint(utils.ServiceHost(utils.BuildServiceName(site.ID.String()), site.Namespace), ":", constants.SitePort)
+	out.URL.Path = upstreamPath
+	out.URL.RawPath = ""
+	out.Host = ""
+
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		out.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		out.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	p.proxy.ServeHTTP(rw, out)
+}
+
+// Called when the site's service can't be reached or fails mid response
+func (p *ProxyHandler) upstreamError(rw http.ResponseWriter, r *http.Request, err error) {
+	p.l.Print("error proxying to ", r.URL.Host, " : ", err)
+	if errors.Is(err, context.Canceled) {
+		// client went away
+		return
+	}
+	renderPage(rw, unavailablePage)
+}
+
+// Serves a file of a Storage site straight from the blob store
+func (p *ProxyHandler) serveFromStorage(rw http.ResponseWriter, r *http.Request, site *models.Site, filePath string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	object, err := p.storage.GetFile(r.Context(), site, filePath)
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		if errors.Is(err, storage.ErrNotFound) {
+			renderPage(rw, notFoundPage)
+			return
+		}
+		p.l.Print("error reading from blob store : ", err)
+		renderPage(rw, unavailablePage)
+		return
 	}
-	resp, err := http.Get(finalURL.String())
-	fmt.Printf("resp: %v\n", resp.Body)
-	defer resp.Body.Close()
-	responseData, err := ioutil.ReadAll(resp.Body)
+	defer object.Body.Close()
 
-	rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	rw.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-	rw.Write(responseData)
+	if object.ETag != "" {
+		rw.Header().Set("ETag", object.ETag)
+		if r.Header.Get("If-None-Match") == object.ETag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if !object.LastModified.IsZero() {
+		rw.Header().Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if object.ContentType != "" {
+		rw.Header().Set("Content-Type", object.ContentType)
+	}
+	if object.Size >= 0 {
+		rw.Header().Set("Content-Length", fmt.Sprint(object.Size))
+	}
+	rw.WriteHeader(http.StatusOK)
 
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(rw, object.Body); err != nil {
+		p.l.Print("error serving file : ", err)
+	}
 }
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/dtos"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+/*
+Change the replicas and resources of a site. A site with more max than min replicas is
+scaled by an autoscaler on its cpu utilisation.
+
+A deployed site's deployment and autoscaler are updated in place, without a rebuild. New
+resources roll out new pods of the current image. Limits of the project's plan can't be
+exceeded.
+*/
+func (f *SiteHandler) UpdateScaling(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	var data dtos.ScalingDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+	if site.HostingMode == string(constants.StorageHosting) {
+		http.Error(rw, "Storage sites are served by the proxy and have no replicas to scale", 400)
+		return
+	}
+
+	if data.MinReplicas != 0 {
+		site.MinReplicas = data.MinReplicas
+	}
+	if data.MaxReplicas != 0 {
+		site.MaxReplicas = data.MaxReplicas
+	}
+	// a min above the current max moves the max with it
+	if data.MaxReplicas == 0 && site.MinReplicas > site.MaxReplicas {
+		site.MaxReplicas = site.MinReplicas
+	}
+	if data.TargetCPU != 0 {
+		site.TargetCPU = data.TargetCPU
+	}
+	if data.CPURequest != "" {
+		site.CPURequest = data.CPURequest
+	}
+	if data.CPULimit != "" {
+		site.CPULimit = data.CPULimit
+	}
+	if data.MemoryRequest != "" {
+		site.MemoryRequest = data.MemoryRequest
+	}
+	if data.MemoryLimit != "" {
+		site.MemoryLimit = data.MemoryLimit
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if err := validateScaling(site, config); err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+
+	// sites that aren't deployed get the new scaling with their first deployment
+	if site.DeployStatus != string(constants.NotDeployed) {
+		if err := f.service.ScaleSite(f.kw, r.Context(), site.Namespace, site); err != nil {
+			f.l.Print("error scaling site : ", err)
+			http.Error(rw, "Error scaling your site", 500)
+			return
+		}
+	}
+	f.updateSite(site, map[string]interface{}{
+		"min_replicas":   site.MinReplicas,
+		"max_replicas":   site.MaxReplicas,
+		"target_cpu":     site.TargetCPU,
+		"cpu_request":    site.CPURequest,
+		"cpu_limit":      site.CPULimit,
+		"memory_request": site.MemoryRequest,
+		"memory_limit":   site.MemoryLimit,
+	})
+
+	err = site.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// Checks the replicas and resources of a site are valid and within the limits of its project's plan
+func validateScaling(site *models.Site, config *models.Config) error {
+	if site.MinReplicas < 1 {
+		return errors.New("minReplicas must be at least 1")
+	}
+	if site.MaxReplicas < site.MinReplicas {
+		return errors.New("maxReplicas can't be less than minReplicas")
+	}
+	if site.MaxReplicas > config.MaxReplicas {
+		return fmt.Errorf("your plan allows up to %v replicas", config.MaxReplicas)
+	}
+
+	resources, err := services.SiteScaling(site).Resources()
+	if err != nil {
+		return errors.New("invalid cpu or memory quantity : " + err.Error())
+	}
+	// the autoscaler works on utilisation of the cpu request
+	if site.MaxReplicas > site.MinReplicas && resources.Requests.Cpu().IsZero() {
+		return errors.New("autoscaled sites need a cpuRequest")
+	}
+
+	plan := []struct {
+		name corev1.ResourceName
+		max  string
+	}{{corev1.ResourceCPU, config.MaxCPU}, {corev1.ResourceMemory, config.MaxMemory}}
+	for _, p := range plan {
+		name, max := p.name, p.max
+		planLimit, err := resource.ParseQuantity(max)
+		if err != nil {
+			return errors.New("invalid plan limit of " + string(name))
+		}
+
+		limit, ok := resources.Limits[name]
+		if !ok {
+			return errors.New("a " + string(name) + " limit is required")
+		}
+		if request, ok := resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+			return errors.New("the " + string(name) + " request can't be more than the limit")
+		}
+		if limit.Cmp(planLimit) > 0 {
+			return fmt.Errorf("your plan allows up to %v of %v per replica", max, name)
+		}
+	}
+	return nil
+}
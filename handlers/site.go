@@ -2,43 +2,74 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"sync"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/archive"
 	"github.com/Cloudbase-Project/static-site-hosting/constants"
 	"github.com/Cloudbase-Project/static-site-hosting/dtos"
 	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/presets"
 	"github.com/Cloudbase-Project/static-site-hosting/services"
 	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 )
 
 type SiteHandler struct {
-	l       *log.Logger
-	service *services.SiteService
-	kw      *kuberneteswrapper.KubernetesWrapper
-	mu      *sync.Mutex
-	fq      *[]string
+	l           *log.Logger
+	service     *services.SiteService
+	kw          kuberneteswrapper.Interface
+	queue       *services.QueueService
+	builds      *services.BuildService
+	deployments *services.DeploymentService
+	storage     *services.StorageService
+	uploads     *services.UploadService
+	manifests   *services.ManifestService
+	jobs        *services.JobService
 }
 
 // create new site
 func NewSiteHandler(
-	client *kubernetes.Clientset,
+	client kubernetes.Interface,
 	l *log.Logger,
 	s *services.SiteService,
-	mu *sync.Mutex,
-	fq *[]string,
+	qs *services.QueueService,
+	bs *services.BuildService,
+	ds *services.DeploymentService,
+	sts *services.StorageService,
+	us *services.UploadService,
+	ms *services.ManifestService,
+	js *services.JobService,
 ) *SiteHandler {
 	kw := kuberneteswrapper.NewWrapper(client)
-	return &SiteHandler{l: l, service: s, kw: kw, mu: mu, fq: fq}
+	return &SiteHandler{
+		l:           l,
+		service:     s,
+		kw:          kw,
+		queue:       qs,
+		builds:      bs,
+		deployments: ds,
+		storage:     sts,
+		uploads:     us,
+		manifests:   ms,
+		jobs:        js,
+	}
 }
 
 // Get all sites created by this user.
@@ -87,10 +118,11 @@ func (f *SiteHandler) UpdateSite(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectId := vars["projectId"]
 
-	var data *dtos.UpdateCodeDTO
-	utils.FromJSON(r.Body, data)
+	// the body is optional. it changes how the site is built
+	var data dtos.UpdateSiteDTO
+	utils.FromJSON(r.Body, &data)
 
-	if _, err := dtos.Validate(data); err != nil {
+	if _, err := dtos.Validate(&data); err != nil {
 		http.Error(rw, "Validation error", 400)
 		return
 	}
@@ -99,37 +131,82 @@ func (f *SiteHandler) UpdateSite(rw http.ResponseWriter, r *http.Request) {
 	site, err := f.service.GetSite(vars["siteId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, err.Error(), 500)
-
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
 	}
 
-	site.BuildStatus = string(constants.Building)
-	// save it
-	f.service.SaveSite(site)
-
-	imageName := utils.BuildImageName(site.ID.String())
-
-	// build image
-	f.kw.CreateImageBuilder(&kuberneteswrapper.ImageBuilder{
-		Ctx:       r.Context(),
-		Namespace: constants.Namespace,
-		SiteId:    site.ID.String(),
-		ImageName: imageName,
-	})
-
-	rw.Write([]byte("Building new image for your updated code"))
-
-	result := f.service.WatchImageBuilder(f.kw, site, constants.Namespace)
-	if result.Err != nil {
-		f.l.Print("error watching image builder", result.Err)
+	if data.Preset != "" {
+		site.Preset = data.Preset
+	}
+	if data.BuildCommand != "" {
+		site.BuildCommand = data.BuildCommand
+	}
+	if data.OutputDir != "" {
+		site.OutputDir = data.OutputDir
+	}
+	if data.RepoURL != "" {
+		site.RepoURL = data.RepoURL
+	}
+	if data.Ref != "" {
+		site.Ref = data.Ref
+	}
+	if data.Subdirectory != "" {
+		site.Subdirectory = data.Subdirectory
+	}
+	if data.DeployKeySecret != "" {
+		site.DeployKeySecret = data.DeployKeySecret
+	}
+	if err := validateBuildSettings(site); err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	if data.DeployKeySecret != "" && !f.checkDeployKey(rw, r, site) {
+		return
+	}
+	// the build reads the site again, and so do later builds
+	if err := f.service.SaveBuildSettings(site); err != nil {
+		http.Error(rw, "DB error", 500)
+		return
 	}
 
-	site.BuildFailReason = result.Reason
-	site.BuildStatus = result.Status
-	// TODO: Should Come back to this. maybe have to add lastAction  = update
-	site.LastAction = string(constants.UpdateAction)
-	site.DeployStatus = string(constants.RedeployRequired)
-	f.service.SaveSite(site)
+	var build *models.Build
+	var job *models.BuildJob
+	if site.SourceType == string(constants.GitSource) {
+		// rebuild from the head of the site's ref
+		build, job, err = f.enqueueGitBuild(site, "")
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+	} else {
+		// rebuild from the last uploaded archive of the site
+		latest, err := f.queue.LatestJob(site.ID)
+		if err != nil {
+			http.Error(rw, "No uploaded files found for this site", 400)
+			return
+		}
+		previous, err := f.builds.GetBuild(site.ID, latest.BuildID.String())
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+		build, err = f.builds.CreateBuild(site.ID, previous.ArtifactChecksum)
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+		job, err = f.queue.Enqueue(site.ID, build.ID, latest.FileName)
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+	}
 
+	// the site has to be redeployed once the new image is built
+	f.startBuild(rw, r, site, build, job, constants.UpdateAction)
 }
 
 func (f *SiteHandler) DeleteSite(rw http.ResponseWriter, r *http.Request) {
@@ -141,19 +218,35 @@ func (f *SiteHandler) DeleteSite(rw http.ResponseWriter, r *http.Request) {
 
 	projectId := vars["projectId"]
 
+	site, err := f.service.GetSite(siteId, ownerId, projectId)
+	if err != nil || site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
 	// delete it.
-	err := f.service.DeleteSite(siteId, ownerId, projectId)
+	err = f.service.DeleteSite(siteId, ownerId, projectId)
 	if err != nil {
 		f.l.Print(err)
 		http.Error(rw, "DB error", 500)
 	}
+
+	if site.HostingMode == string(constants.StorageHosting) {
+		err = f.storage.DeleteSite(context.Background(), siteId)
+		if err != nil {
+			f.l.Print(err)
+			http.Error(rw, "Err deleting files", 500)
+		}
+		return
+	}
+
 	// TODO: delete resources
 	serviceName := utils.BuildServiceName(siteId)
 
 	err = f.service.DeleteSiteResources(
 		f.kw,
 		context.Background(),
-		constants.Namespace,
+		site.Namespace,
 		siteId,
 		serviceName,
 	)
@@ -178,12 +271,13 @@ func (f *SiteHandler) GetSiteLogs(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if site.DeployStatus == string(constants.Deployed) &&
-		site.LastAction == string(constants.DeployAction) {
+		(site.LastAction == string(constants.DeployAction) ||
+			site.LastAction == string(constants.RollbackAction)) {
 		// get the logs for the given site
 		err := f.service.GetDeploymentLogs(
 			f.kw,
 			r.Context(),
-			constants.Namespace,
+			site.Namespace,
 			site.ID.String(),
 			true,
 			rw,
@@ -207,7 +301,8 @@ func (f *SiteHandler) GetSiteLogs(rw http.ResponseWriter, r *http.Request) {
 /*
 Create a deployment and a clusterIP service for the site.
 
-Errors if no image is found for the site
+Errors if no image is found for the site. The rollout is watched by a job, which is returned
+with a 202.
 */
 func (f *SiteHandler) DeploySite(rw http.ResponseWriter, r *http.Request) {
 
@@ -220,6 +315,11 @@ func (f *SiteHandler) DeploySite(rw http.ResponseWriter, r *http.Request) {
 	site, err := f.service.GetSite(vars["siteId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
 	}
 
 	if site.BuildStatus == string(constants.BuildSuccess) &&
@@ -229,66 +329,331 @@ func (f *SiteHandler) DeploySite(rw http.ResponseWriter, r *http.Request) {
 
 		deploymentLabel := map[string]string{"app": site.ID.String()}
 
-		// TODO: Should change to constant
-		replicas := int32(1)
+		build, err := f.builds.LatestSuccessfulBuild(site.ID)
+		if err != nil {
+			http.Error(rw, "No successful build found for this site", 400)
+			return
+		}
 
-		imageName := utils.BuildImageName(site.ID.String())
+		if site.HostingMode == string(constants.StorageHosting) {
+			deployment, err := f.activateBuild(site, build, constants.DeployAction)
+			if err != nil {
+				http.Error(rw, "DB error", 500)
+				return
+			}
+			deployment.ToJSON(rw)
+			return
+		}
+
+		imageName := f.builds.DeployableImage(build)
+
+		deployment, err := f.deployments.CreateDeployment(build, imageName, constants.DeployAction)
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
 
 		err = f.service.DeploySite(
 			f.kw,
 			r.Context(),
-			constants.Namespace,
+			site.Namespace,
 			site.ID.String(),
 			deploymentLabel,
 			imageName,
-			replicas,
+			services.SiteScaling(site),
 		)
 		if err != nil {
 			fmt.Printf("err: %v\n", err.Error())
+			f.deployments.FinishDeployment(deployment, services.WatchResult{
+				Status: string(constants.DeploymentFailed),
+				Reason: err.Error(),
+			})
 			http.Error(rw, "Error deploying your image.", 500)
 			return
 		}
 
+		// the new deployment starts with its replicas, even if the site was asleep before
+		if err := f.service.MarkAwake(site); err != nil {
+			f.l.Print("error marking site awake : ", err)
+		}
+
 		// update status in db
 		site.DeployStatus = string(constants.Deploying)
-		f.service.SaveSite(site)
+		f.updateSite(site, map[string]interface{}{"deploy_status": site.DeployStatus})
 
-		rw = utils.SetSSEHeaders(rw)
-		fmt.Fprintf(rw, "data: %v\n\n", "Deploying your site...")
+		f.startRollout(rw, r, site, build, deployment, constants.DeployAction)
 
-		if f, ok := rw.(http.Flusher); ok {
-			f.Flush()
-		}
+	} else {
+		http.Error(rw, "Cannot perform this action currently", 400)
+	}
 
-		// Watch status
-		// watch for 1 min and then close everything
+}
 
-		result := f.service.WatchDeployment(f.kw, site, constants.Namespace)
-		if result.Err != nil {
-			http.Error(rw, "Error watching deployment", 500)
-		}
+// Serves the archive of a build job to the kaniko init container that claims it.
+func (f *SiteHandler) GetFromQueue(rw http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["jobId"]
+
+	job, err := f.queue.Claim(jobId)
+	if err != nil {
+		f.l.Print("error claiming job ", jobId, " : ", err)
+		http.Error(rw, "Job not available", 404)
+		return
+	}
+
+	http.ServeFile(rw, r, "./zipfiles/"+job.FileName)
+
+	if err := f.queue.MarkRunning(jobId); err != nil {
+		f.l.Print("error marking job as running : ", err)
+	}
+}
+
+// Builds the site the way its hosting mode needs. An image for Container sites and the
+// files in the blob store for Storage sites.
+func (f *SiteHandler) runBuild(
+	ctx context.Context,
+	report func(services.LogEvent),
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+) services.WatchResult {
+	if site.HostingMode == string(constants.StorageHosting) {
+		return f.publishBuild(ctx, site, build, job)
+	}
+	return f.buildImage(ctx, report, site, build, job)
+}
 
-		site.DeployFailReason = result.Reason
-		site.DeployStatus = result.Status
+// Extracts the archive of a job into the blob store. The job is claimed and processed in
+// process since no builder pod is needed.
+func (f *SiteHandler) publishBuild(
+	ctx context.Context,
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+) (result services.WatchResult) {
+	f.builds.StartBuild(build)
+	defer func() { f.builds.FinishBuild(build, result) }()
+
+	if _, err := f.queue.Claim(job.ID.String()); err != nil {
+		return services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+	}
+
+	count, err := f.storage.Publish(ctx, build, "./zipfiles/"+job.FileName, sitePreset(site).OutputDir)
+	if err != nil {
+		f.queue.Fail(job.ID.String(), err.Error())
+		return services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+	}
+
+	if err := f.queue.Complete(job.ID.String()); err != nil {
+		f.l.Print("error completing job : ", err)
+	}
+	build.Logs = fmt.Sprintf("Published %v files\n", count)
+	return services.WatchResult{Status: string(constants.BuildSuccess)}
+}
+
+// Activates a build of a Storage site. The proxy serves it from the next request on.
+func (f *SiteHandler) activateBuild(
+	site *models.Site,
+	build *models.Build,
+	action constants.LastAction,
+) (*models.Deployment, error) {
+	deployment, err := f.deployments.CreateDeployment(build, "", action)
+	if err != nil {
+		return nil, err
+	}
+
+	site.ActiveBuildID = &build.ID
+	site.DeployStatus = string(constants.Deployed)
+	site.DeployFailReason = ""
+	site.LastAction = string(action)
+	if action == constants.RedeployAction {
 		site.LastAction = string(constants.DeployAction)
-		f.service.SaveSite(site)
+	}
+	f.updateSite(site, map[string]interface{}{
+		"active_build_id":    site.ActiveBuildID,
+		"deploy_status":      site.DeployStatus,
+		"deploy_fail_reason": site.DeployFailReason,
+		"last_action":        site.LastAction,
+	})
 
-		// TODO: register with the custom router
-		fmt.Fprintf(rw, "data: %v\n\n", "Deployed your site successfully")
+	f.deployments.FinishDeployment(deployment, services.WatchResult{Status: string(constants.Deployed)})
+	return deployment, nil
+}
 
-	} else {
-		http.Error(rw, "Cannot perform this action currently", 400)
+// Runs the image builder for a job and watches it. Waits for a free build slot before every
+// attempt. Failed builds are retried while the job has attempts left.
+func (f *SiteHandler) buildImage(
+	ctx context.Context,
+	report func(services.LogEvent),
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+) (result services.WatchResult) {
+	// log lines are kept with the build and sent to the client and anyone following the build
+	emit := func(event services.LogEvent) {
+		f.builds.PublishLog(build, event)
+		report(event)
 	}
 
+	// every build gets an immutable tag
+	imageName := utils.BuildImageName(site.ID.String(), utils.BuildImageTag(build.Number, build.ArtifactChecksum))
+	build.Image = imageName
+	f.builds.StartBuild(build)
+	f.builds.OpenLogs(build.ID)
+	defer f.builds.CloseLogs(build.ID)
+	defer func() {
+		emit(services.LogEvent{Type: services.LogPhase, Data: "build " + result.Status})
+		f.builds.FinishBuild(build, result)
+	}()
+
+	// deploy keys are secrets of the service's namespace. the builder mounts a copy in the project's
+	if site.SourceType == string(constants.GitSource) && site.DeployKeySecret != "" {
+		// checked on every build, the secret's labels can have changed since the site was saved
+		if err := f.service.CheckDeployKey(f.kw, ctx, site); err != nil {
+			f.queue.Fail(job.ID.String(), err.Error())
+			return services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+		}
+		if site.Namespace != constants.Namespace {
+			if err := f.kw.CopySecret(ctx, constants.Namespace, site.DeployKeySecret, site.Namespace); err != nil {
+				f.queue.Fail(job.ID.String(), err.Error())
+				reason := "Error copying the deploy key : " + err.Error()
+				return services.WatchResult{Status: string(constants.BuildFailed), Reason: reason, Err: err}
+			}
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := f.waitForBuildSlot(ctx, report, job); err != nil {
+			f.queue.Fail(job.ID.String(), err.Error())
+			return services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+		}
+
+		podName := utils.BuildImageBuilderName(site.ID.String(), build.ID.String(), attempt)
+
+		// git builds don't fetch their job from the queue, so it is claimed here
+		var source *kuberneteswrapper.GitSource
+		if site.SourceType == string(constants.GitSource) {
+			if _, err := f.queue.Claim(job.ID.String()); err != nil {
+				return services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+			}
+			if err := f.queue.MarkRunning(job.ID.String()); err != nil {
+				f.l.Print("error marking job as running : ", err)
+			}
+			source = &kuberneteswrapper.GitSource{
+				RepoURL:         site.RepoURL,
+				Ref:             build.GitRef,
+				Subdirectory:    site.Subdirectory,
+				DeployKeySecret: site.DeployKeySecret,
+			}
+		}
+
+		preset := sitePreset(site)
+		builder := &kuberneteswrapper.ImageBuilder{
+			Ctx:       ctx,
+			Namespace: site.Namespace,
+			Name:      podName,
+			SiteId:    site.ID.String(),
+			BuildId:   build.ID.String(),
+			JobId:     job.ID.String(),
+			ImageName: imageName,
+			// the site is served on the port of its service
+			Dockerfile: preset.Dockerfile(strconv.Itoa(constants.SitePort)),
+			Git:        source,
+		}
+		if preset.NeedsBuild() {
+			builder.BuildImage = preset.BuildImage
+			builder.BuildScript = preset.BuildScript()
+		}
+
+		_, err := f.kw.CreateImageBuilder(builder)
+		if err != nil {
+			result = services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error(), Err: err}
+		} else {
+			emit(services.LogEvent{Type: services.LogPhase, Data: fmt.Sprintf("pod %v pending (attempt %v)", podName, attempt)})
+
+			streamCtx, cancelStream := context.WithCancel(context.Background())
+			streamed := make(chan int, 1)
+			go func() {
+				streamed <- f.builds.StreamBuilderLogs(f.kw, streamCtx, site.Namespace, podName, emit)
+			}()
+
+			result = f.service.WatchImageBuilder(f.kw, ctx, podName, site.Namespace)
+			if result.Err != nil {
+				f.l.Print("error watching image builder : ", result.Err)
+			}
+
+			// give the stream a moment to drain the last lines once the pod is done
+			lines := 0
+			select {
+			case lines = <-streamed:
+			case <-time.After(10 * time.Second):
+				cancelStream()
+				lines = <-streamed
+			}
+			cancelStream()
+
+			// delete the pod the watch saw finishing
+			observed := result.PodName
+			if observed == "" {
+				observed = podName
+			}
+			// keep the logs even if they couldn't be streamed
+			if lines == 0 {
+				f.builds.CaptureLogs(f.kw, context.Background(), site.Namespace, observed, build)
+			}
+
+			err = f.service.DeleteImageBuilder(f.kw, context.Background(), site.Namespace, observed)
+			if err != nil {
+				f.l.Print("error deleting image builder : ", err)
+			}
+		}
+
+		if result.Status == string(constants.BuildSuccess) {
+			if err := f.queue.Complete(job.ID.String()); err != nil {
+				f.l.Print("error completing job : ", err)
+			}
+			return result
+		}
+
+		retry, err := f.queue.Fail(job.ID.String(), result.Reason)
+		if err != nil {
+			f.l.Print("error failing job : ", err)
+		}
+		if !retry {
+			return result
+		}
+		emit(services.LogEvent{Type: services.LogPhase, Data: "build failed, retrying"})
+	}
 }
 
-func (f *SiteHandler) GetFromQueue(rw http.ResponseWriter, r *http.Request) {
-	f.mu.Lock()
-	var fileString string
-	fileString = (*f.fq)[0]
+// Blocks until the job gets one of the cluster wide build slots, reporting the queue position
+// while it waits.
+func (f *SiteHandler) waitForBuildSlot(ctx context.Context, report func(services.LogEvent), job *models.BuildJob) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
-	f.mu.Unlock()
-	http.ServeFile(rw, r, "./zipfiles/"+fileString)
+	for {
+		acquired, err := f.queue.AcquireSlot(job.ID.String())
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		position, err := f.queue.Position(job)
+		if err == nil {
+			report(services.LogEvent{
+				Type: services.LogMessage,
+				Data: fmt.Sprintf("Waiting for a free builder. Position in queue : %v", position+1),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 func (f *SiteHandler) GetFileName(rw http.ResponseWriter, r *http.Request) {
@@ -297,9 +662,56 @@ func (f *SiteHandler) GetFileName(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectId := vars["projectId"]
 
-	site, err := f.service.CreateSite(ownerId, projectId)
+	// the body is optional
+	var data dtos.CreateSiteDTO
+	utils.FromJSON(r.Body, &data)
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	hostingMode := constants.ContainerHosting
+	if data.HostingMode != "" {
+		hostingMode = constants.HostingMode(data.HostingMode)
+	}
+	if data.Preset == "" {
+		data.Preset = constants.DefaultPreset
+	}
+
+	if data.SourceType == "" {
+		data.SourceType = string(constants.ArchiveSource)
+	}
+
+	settings := models.Site{
+		HostingMode:     string(hostingMode),
+		Preset:          data.Preset,
+		BuildCommand:    data.BuildCommand,
+		OutputDir:       data.OutputDir,
+		SourceType:      data.SourceType,
+		RepoURL:         data.RepoURL,
+		Ref:             data.Ref,
+		Subdirectory:    data.Subdirectory,
+		DeployKeySecret: data.DeployKeySecret,
+	}
+	if err := validateBuildSettings(&settings); err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+
+	site, err := f.service.CreateSite(ownerId, projectId, settings)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
+	}
+	// the site's config is known once it is created
+	if site.DeployKeySecret != "" && !f.checkDeployKey(rw, r, site) {
+		f.service.DeleteSite(site.ID.String(), ownerId, projectId)
+		return
+	}
+	if err := f.service.SetupNamespace(f.kw, r.Context(), site); err != nil {
+		f.l.Print("error setting up namespace ", site.Namespace, " : ", err)
+		f.service.DeleteSite(site.ID.String(), ownerId, projectId)
+		http.Error(rw, "Error setting up the project's namespace", 500)
+		return
 	}
 	fmt.Printf("site: %v\n", site)
 
@@ -320,19 +732,6 @@ func (f *SiteHandler) CreateSite(rw http.ResponseWriter, r *http.Request) {
 	// TODO: 1. authenicate and get userId
 	// TODO: 2. check if the service is enabled
 
-	// FILE UPLOAD HANDLING
-	r.ParseMultipartForm(10 << 20)
-	file, handler, err := r.FormFile("myFile")
-	if err != nil {
-		fmt.Println("Error Retrieving the File")
-		fmt.Println(err)
-		return
-	}
-	defer file.Close()
-	fmt.Printf("Uploaded File: %+v\n", handler.Filename)
-	fmt.Printf("File Size: %+v\n", handler.Size)
-	fmt.Printf("MIME Header: %+v\n", handler.Header)
-
 	ownerId := r.Context().Value("ownerId").(string)
 
 	vars := mux.Vars(r)
@@ -344,88 +743,208 @@ func (f *SiteHandler) CreateSite(rw http.ResponseWriter, r *http.Request) {
 	site, err := f.service.GetSite(siteId, ownerId, projectId)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
 	}
-
-	// read all of the contents of our uploaded file into a
-	// byte array
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		fmt.Println(err)
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
 	}
-	// write this byte array to our temporary file
-	// tempFile.Write(fileBytes)
 
-	err = ioutil.WriteFile("./zipfiles/"+site.ID.String()+".zip", fileBytes, 0777)
-	if err != nil {
-		fmt.Println(err)
-	}
-	// return that we have successfully uploaded our file!
-	fmt.Fprintf(rw, "Successfully Uploaded File\n")
+	var build *models.Build
+	var job *models.BuildJob
+	if site.SourceType == string(constants.GitSource) {
+		// the builder clones the repository. nothing is uploaded
+		build, job, err = f.enqueueGitBuild(site, "")
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+	} else {
+		config, err := f.service.GetConfig(site)
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+
+		// FILE UPLOAD HANDLING
+		// the compressed upload can't be much larger than the files in it
+		r.Body = http.MaxBytesReader(rw, r.Body, config.MaxUploadSize+(1<<20))
+		r.ParseMultipartForm(10 << 20)
+		if r.MultipartForm == nil || len(r.MultipartForm.File["myFile"]) == 0 {
+			http.Error(rw, "No file uploaded in myFile", 400)
+			return
+		}
+		files := r.MultipartForm.File["myFile"]
 
-	f.mu.Lock()
-	*f.fq = append(*f.fq, site.ID.String()+".zip")
-	f.mu.Unlock()
+		// an archive, or the files of a folder, as a zip
+		fileBytes, err := archive.FromUpload(files, uploadLimits(site, config))
+		if err != nil {
+			archiveError(rw, err)
+			return
+		}
+
+		var ok bool
+		build, job, ok = f.enqueueUpload(rw, site, config, fileBytes, uuid.New())
+		if !ok {
+			return
+		}
+	}
 
-	// TODO: get these from env variables
-	Registry := os.Getenv("REGISTRY")
-	Project := os.Getenv("PROJECT_NAME")
+	f.startBuild(rw, r, site, build, job, constants.BuildAction)
+}
 
-	imageName := Registry + "/" + Project + "/" + site.ID.String() + ":latest"
+// Validates an uploaded zip and queues a build of it with the given id. Writes an error
+// response and returns false if the upload is rejected.
+func (f *SiteHandler) enqueueUpload(
+	rw http.ResponseWriter,
+	site *models.Site,
+	config *models.Config,
+	fileBytes []byte,
+	buildId uuid.UUID,
+) (*models.Build, *models.BuildJob, bool) {
+	report := archive.Validate(fileBytes, uploadLimits(site, config))
+	if !report.Valid {
+		rejectUpload(rw, report)
+		return nil, nil, false
+	}
 
-	// create namespace if not exist
+	checksum := sha256.Sum256(fileBytes)
+	build, err := f.builds.CreateBuildWithID(buildId, site.ID, hex.EncodeToString(checksum[:]))
 	if err != nil {
-		// namespace already exists. ignore
-		fmt.Println("namespace already exists. ignoring...")
-		fmt.Printf("err: %v\n", err)
+		http.Error(rw, "DB error", 500)
+		return nil, nil, false
 	}
 
-	// create kaniko pod
+	job, err := f.queue.Enqueue(site.ID, build.ID, "")
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return nil, nil, false
+	}
 
-	_, err = f.kw.CreateImageBuilder(
-		&kuberneteswrapper.ImageBuilder{
-			Ctx:       r.Context(),
-			Namespace: constants.Namespace,
-			SiteId:    site.ID.String(),
-			ImageName: imageName,
-		})
+	err = ioutil.WriteFile("./zipfiles/"+job.FileName, fileBytes, 0777)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return build, job, true
+}
 
+/*
+Starts a job that runs a queued build and responds with it. action becomes the site's last
+action once the build is done. Sites built by an update have to be redeployed.
+*/
+func (f *SiteHandler) startBuild(
+	rw http.ResponseWriter,
+	r *http.Request,
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+	action constants.LastAction,
+) {
+	bgJob, err := f.jobs.CreateJob(site.ID, action, &build.ID, nil)
 	if err != nil {
-		http.Error(rw, "error : "+err.Error(), 400)
+		http.Error(rw, "DB error", 500)
+		return
 	}
 
-	rw = utils.SetSSEHeaders(rw)
+	site.BuildStatus = string(constants.Building)
+	f.updateSite(site, map[string]interface{}{"build_status": site.BuildStatus})
 
-	fmt.Fprintf(rw, "data: %v\n\n", "Building Image for your code")
+	f.jobs.Run(bgJob, func(ctx context.Context, report func(services.LogEvent)) services.WatchResult {
+		return f.buildSite(ctx, report, site, build, job, action)
+	})
+	acceptJob(rw, r, bgJob)
+}
 
-	if f, ok := rw.(http.Flusher); ok {
-		f.Flush()
-	}
+// Runs a queued build and saves the result on the site
+func (f *SiteHandler) buildSite(
+	ctx context.Context,
+	report func(services.LogEvent),
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+	action constants.LastAction,
+) services.WatchResult {
+	report(services.LogEvent{Type: services.LogMessage, Data: "Building Image for your code"})
 
-	result := f.service.WatchImageBuilder(f.kw, site, constants.Namespace)
-	if result.Err != nil {
-		http.Error(rw, "Error watching image builder", 500)
-		fmt.Println("err : ", result.Err.Error())
+	// create kaniko pod and wait for the build
+	result := f.runBuild(ctx, report, site, build, job)
+
+	site.BuildFailReason = result.Reason
+	site.BuildStatus = result.Status
+	site.LastAction = string(action)
+	status := map[string]interface{}{
+		"build_status":      site.BuildStatus,
+		"build_fail_reason": site.BuildFailReason,
+		"last_action":       site.LastAction,
 	}
+	if action == constants.UpdateAction {
+		site.DeployStatus = string(constants.RedeployRequired)
+		status["deploy_status"] = site.DeployStatus
+	}
+	f.updateSite(site, status)
+	return result
+}
 
-	err = f.service.DeleteImageBuilder(f.kw, r.Context(), constants.Namespace)
+/*
+Starts a job that watches a rollout of the site's deployment and responds with it. action
+becomes the site's last action once the rollout is done.
+*/
+func (f *SiteHandler) startRollout(
+	rw http.ResponseWriter,
+	r *http.Request,
+	site *models.Site,
+	build *models.Build,
+	deployment *models.Deployment,
+	action constants.LastAction,
+) {
+	bgJob, err := f.jobs.CreateJob(site.ID, action, &build.ID, &deployment.ID)
 	if err != nil {
-		fmt.Printf("err deleting image builder: %v\n", err.Error())
+		http.Error(rw, "DB error", 500)
+		return
 	}
-	site.BuildFailReason = result.Reason
-	site.BuildStatus = result.Status
-	site.LastAction = string(constants.BuildAction)
-	f.service.SaveSite(site)
-	resp := struct {
-		Site    models.Site
-		Message string
-	}{
-		Site:    *site,
-		Message: "Built image for Site",
+
+	f.jobs.Run(bgJob, func(ctx context.Context, report func(services.LogEvent)) services.WatchResult {
+		return f.watchRollout(ctx, report, site, deployment, action)
+	})
+	acceptJob(rw, r, bgJob)
+}
+
+// Watches a rollout of the site's deployment and saves the result on the site
+func (f *SiteHandler) watchRollout(
+	ctx context.Context,
+	report func(services.LogEvent),
+	site *models.Site,
+	deployment *models.Deployment,
+	action constants.LastAction,
+) services.WatchResult {
+	report(services.LogEvent{Type: services.LogMessage, Data: "Deploying your site..."})
+
+	result := f.service.WatchDeployment(f.kw, ctx, site, site.Namespace)
+	if result.Err != nil {
+		f.l.Print("error watching deployment : ", result.Err)
+		result.Status = string(constants.DeploymentFailed)
+		result.Reason = result.Err.Error()
 	}
+	f.deployments.FinishDeployment(deployment, result)
 
-	json.NewEncoder(rw).Encode(resp)
+	site.DeployFailReason = result.Reason
+	site.DeployStatus = result.Status
+	site.LastAction = string(action)
+	if action == constants.RedeployAction {
+		site.LastAction = string(constants.DeployAction)
+	}
+	f.updateSite(site, map[string]interface{}{
+		"deploy_status":      site.DeployStatus,
+		"deploy_fail_reason": site.DeployFailReason,
+		"last_action":        site.LastAction,
+	})
+
+	report(services.LogEvent{Type: services.LogMessage, Data: "Deployment " + result.Status})
+	return result
 }
 
+// Roll the site's deployment out to its latest successful build. The rollout is watched by a
+// job, which is returned with a 202.
 func (f *SiteHandler) RedeploySite(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ownerId := r.Context().Value("ownerId").(string)
@@ -435,6 +954,11 @@ func (f *SiteHandler) RedeploySite(rw http.ResponseWriter, r *http.Request) {
 	site, err := f.service.GetSite(vars["siteId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
 	}
 
 	if site.LastAction == string(constants.UpdateAction) &&
@@ -442,18 +966,291 @@ func (f *SiteHandler) RedeploySite(rw http.ResponseWriter, r *http.Request) {
 		site.BuildStatus == string(constants.BuildSuccess) {
 		// proceed
 
-		err = f.kw.UpdateDeployment(&kuberneteswrapper.UpdateOptions{
-			Ctx:       context.Background(),
-			Namespace: constants.Namespace,
-			Name:      site.ID.String(),
-		})
+		build, err := f.builds.LatestSuccessfulBuild(site.ID)
+		if err != nil {
+			http.Error(rw, "No successful build found for this site", 400)
+			return
+		}
+
+		if site.HostingMode == string(constants.StorageHosting) {
+			_, err := f.activateBuild(site, build, constants.RedeployAction)
+			if err != nil {
+				http.Error(rw, "DB error", 500)
+				return
+			}
+			rw.Write([]byte("Deployed your code"))
+			return
+		}
+
+		deployment, err := f.redeployBuild(r.Context(), site, build)
 		if err != nil {
 			f.l.Print(err)
 			http.Error(rw, "error occured when redeploying", 500)
+			return
 		}
-		rw.Write([]byte("Deploying your code..."))
+
+		f.startRollout(rw, r, site, build, deployment, constants.RedeployAction)
 
 	} else {
 		http.Error(rw, "Cannot perform this action.", 400)
 	}
 }
+
+// Get the deployment history of a site
+func (f *SiteHandler) ListDeployments(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
+	deployments, err := f.deployments.GetAllDeployments(site.ID)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	err = deployments.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+/*
+Roll the site's deployment back to a previous successful build.
+
+Accepts either the id of a previous deployment or the id of a build.
+*/
+func (f *SiteHandler) RollbackSite(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	var data dtos.RollbackDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	if (data.DeploymentId == "") == (data.BuildId == "") {
+		http.Error(rw, "Exactly one of deploymentId or buildId is required", 400)
+		return
+	}
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+
+	// a rollback patches the existing deployment
+	if site.DeployStatus == string(constants.NotDeployed) ||
+		site.DeployStatus == string(constants.Deploying) {
+		http.Error(rw, "Cannot perform this action currently", 400)
+		return
+	}
+
+	buildId := data.BuildId
+	if data.DeploymentId != "" {
+		previous, err := f.deployments.GetDeployment(site.ID, data.DeploymentId)
+		if err != nil {
+			http.Error(rw, "Deployment not found", 404)
+			return
+		}
+		buildId = previous.BuildID.String()
+	}
+
+	build, err := f.builds.GetBuild(site.ID, buildId)
+	if err != nil {
+		http.Error(rw, "Build not found", 404)
+		return
+	}
+	if build.Status != string(constants.BuildSuccess) {
+		http.Error(rw, "Can only rollback to a successful build", 400)
+		return
+	}
+
+	if site.HostingMode == string(constants.StorageHosting) {
+		deployment, err := f.activateBuild(site, build, constants.RollbackAction)
+		if err != nil {
+			http.Error(rw, "DB error", 500)
+			return
+		}
+		deployment.ToJSON(rw)
+		return
+	}
+
+	imageName := f.builds.DeployableImage(build)
+	deployment, err := f.deployments.CreateDeployment(build, imageName, constants.RollbackAction)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	_, err = f.kw.PatchDeploymentImage(&kuberneteswrapper.UpdateOptions{
+		Ctx:       r.Context(),
+		Namespace: site.Namespace,
+		Name:      site.ID.String(),
+		ImageName: imageName,
+	})
+	if err != nil {
+		f.l.Print("error patching deployment : ", err)
+		f.deployments.FinishDeployment(deployment, services.WatchResult{
+			Status: string(constants.DeploymentFailed),
+			Reason: err.Error(),
+		})
+		http.Error(rw, "error occured when rolling back", 500)
+		return
+	}
+
+	site.DeployStatus = string(constants.Deploying)
+	f.updateSite(site, map[string]interface{}{"deploy_status": site.DeployStatus})
+
+	f.startRollout(rw, r, site, build, deployment, constants.RollbackAction)
+}
+
+// Saves the status columns of a site that changed. The rest of the row is left alone, see
+// SiteService.UpdateSite.
+func (f *SiteHandler) updateSite(site *models.Site, columns map[string]interface{}) {
+	if err := f.service.UpdateSite(site.ID, columns); err != nil {
+		f.l.Print("error saving site ", site.ID, " : ", err)
+	}
+}
+
+// Returns the preset of the site with its overrides applied
+func sitePreset(site *models.Site) presets.Preset {
+	preset, err := presets.Get(site.Preset)
+	if err != nil {
+		preset, _ = presets.Get(constants.DefaultPreset)
+	}
+	return preset.WithOverrides(site.BuildCommand, site.OutputDir)
+}
+
+// Checks the preset and source of a site exist and can be used with its hosting mode.
+// Storage sites are published as uploaded, so their preset can't have a build step and
+// they can't be built from a repository.
+func validateBuildSettings(site *models.Site) error {
+	preset, err := presets.Get(site.Preset)
+	if err != nil {
+		return fmt.Errorf("%w. available presets : %v", err, strings.Join(presets.Names(), ", "))
+	}
+	if site.HostingMode == string(constants.StorageHosting) && preset.NeedsBuild() {
+		return errors.New("preset " + preset.Name + " needs a build and can't be used with Storage hosting. upload the built site with the static preset instead")
+	}
+
+	if site.SourceType != string(constants.GitSource) {
+		return nil
+	}
+	if site.HostingMode == string(constants.StorageHosting) {
+		return errors.New("git sources can't be used with Storage hosting")
+	}
+	if !validRepoURL(site.RepoURL) {
+		return errors.New("repoUrl must be an http(s), ssh or git@host:path url")
+	}
+	if site.Subdirectory != "" {
+		dir := path.Clean(site.Subdirectory)
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+			return errors.New("subdirectory must be a path inside the repository")
+		}
+		site.Subdirectory = dir
+	}
+	if site.DeployKeySecret != "" && len(validation.IsDNS1123Subdomain(site.DeployKeySecret)) > 0 {
+		return errors.New("deployKeySecret must be the name of a secret")
+	}
+	return nil
+}
+
+// Checks the site can use its deploy key. Writes an error response if it can't.
+func (f *SiteHandler) checkDeployKey(rw http.ResponseWriter, r *http.Request, site *models.Site) bool {
+	err := f.service.CheckDeployKey(f.kw, r.Context(), site)
+	if errors.Is(err, services.ErrDeployKeyNotOwned) {
+		http.Error(rw, "deployKeySecret must be a secret labelled "+constants.ConfigLabel+"="+site.ConfigID.String(), 400)
+		return false
+	}
+	if err != nil {
+		f.l.Print("error checking the deploy key of ", site.ID, " : ", err)
+		http.Error(rw, "Error checking the deploy key", 500)
+		return false
+	}
+	return true
+}
+
+// Whether the url is one git can clone
+func validRepoURL(repoURL string) bool {
+	if strings.HasPrefix(repoURL, "git@") {
+		return strings.Contains(repoURL, ":")
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "https" || u.Scheme == "http" || u.Scheme == "ssh"
+}
+
+// Creates a build of a git site and its job. The ref overrides the site's ref, eg: the
+// commit of a push. There is no archive, so the checksum is of the source the build clones.
+func (f *SiteHandler) enqueueGitBuild(site *models.Site, ref string) (*models.Build, *models.BuildJob, error) {
+	if ref == "" {
+		ref = site.Ref
+	}
+	checksum := sha256.Sum256([]byte(site.RepoURL + "#" + ref + ":" + site.Subdirectory))
+	build, err := f.builds.CreateBuild(site.ID, hex.EncodeToString(checksum[:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	build.GitRef = ref
+	f.builds.SaveBuild(build)
+
+	job, err := f.queue.Enqueue(site.ID, build.ID, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return build, job, nil
+}
+
+// Responds with the reasons an upload was rejected
+func rejectUpload(rw http.ResponseWriter, report *archive.Report) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusUnprocessableEntity)
+	report.ToJSON(rw)
+}
+
+// Responds with the error of an upload that couldn't be turned into a zip
+func archiveError(rw http.ResponseWriter, err error) {
+	var limitErr *archive.LimitError
+	switch {
+	case errors.Is(err, archive.ErrUnsupportedFormat):
+		http.Error(rw, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.As(err, &limitErr):
+		rejectUpload(rw, limitErr.Report())
+	default:
+		http.Error(rw, "Error reading upload : "+err.Error(), 400)
+	}
+}
+
+// Limits of an upload of the site. Uploads of sites without a build step are served as they
+// are, so they need an index.html in their output dir.
+func uploadLimits(site *models.Site, config *models.Config) archive.Limits {
+	limits := archive.Limits{
+		MaxTotalSize:        config.MaxUploadSize,
+		MaxFiles:            config.MaxUploadFiles,
+		MaxCompressionRatio: constants.MaxCompressionRatio,
+	}
+	if preset := sitePreset(site); !preset.NeedsBuild() {
+		limits.RequiredFile = strings.TrimPrefix(path.Join("/", preset.OutputDir, "index.html"), "/")
+	}
+	return limits
+}
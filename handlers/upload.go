@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Cloudbase-Project/static-site-hosting/archive"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/dtos"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Writes the state of an upload in the headers tus clients expect
+func setUploadHeaders(rw http.ResponseWriter, upload *models.Upload) {
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	rw.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	rw.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	rw.Header().Set("Cache-Control", "no-store")
+}
+
+/*
+Start a resumable upload of a site's archive, for uploads too large to send in one request.
+
+The archive is sent in chunks with PATCH, the offset to resume from is read with HEAD, and
+the upload is built with a final commit call.
+*/
+func (f *SiteHandler) CreateUpload(rw http.ResponseWriter, r *http.Request) {
+	site, ok := f.getUploadSite(rw, r)
+	if !ok {
+		return
+	}
+
+	var data dtos.CreateUploadDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if data.Length <= 0 {
+		http.Error(rw, "length must be more than 0", 400)
+		return
+	}
+	if data.Length > config.MaxUploadSize+(1<<20) {
+		http.Error(rw, "Upload is larger than the project's upload quota", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload, err := f.uploads.CreateUpload(site.ID, data.Length, data.Checksum)
+	if err != nil {
+		f.l.Print("error creating upload : ", err)
+		http.Error(rw, "Error creating upload", 500)
+		return
+	}
+
+	setUploadHeaders(rw, upload)
+	rw.Header().Set("Location", r.URL.Path+"/"+upload.ID.String())
+	rw.WriteHeader(http.StatusCreated)
+	upload.ToJSON(rw)
+}
+
+// Get the offset to resume an upload from
+func (f *SiteHandler) GetUploadOffset(rw http.ResponseWriter, r *http.Request) {
+	upload, _, ok := f.getUpload(rw, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(rw, upload)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Append a chunk to an upload. Upload-Offset has to be the current offset of the upload.
+func (f *SiteHandler) PatchUpload(rw http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(rw, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(rw, "Invalid Upload-Offset", 400)
+		return
+	}
+
+	upload, _, ok := f.getUpload(rw, r)
+	if !ok {
+		return
+	}
+
+	err = f.uploads.WriteChunk(upload, offset, r.Body)
+	setUploadHeaders(rw, upload)
+	switch {
+	case errors.Is(err, services.ErrUploadOffsetMismatch), errors.Is(err, services.ErrUploadCommitted):
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		// the bytes received so far are kept
+		f.l.Print("error writing chunk of upload ", upload.ID, " : ", err)
+		http.Error(rw, "Error writing chunk", 500)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Cancel an upload and delete its chunks
+func (f *SiteHandler) DeleteUpload(rw http.ResponseWriter, r *http.Request) {
+	upload, _, ok := f.getUpload(rw, r)
+	if !ok {
+		return
+	}
+	if err := f.uploads.DeleteUpload(upload); err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Build a complete upload. The sha256 of the upload is checked against the checksum given when
+creating it, or the one in the body. The archive is then validated and built like a direct
+upload, in a job.
+
+The upload is locked from the checks to the commit, so concurrent commits build it once.
+*/
+func (f *SiteHandler) CommitUpload(rw http.ResponseWriter, r *http.Request) {
+	// the body is optional
+	var data dtos.CommitUploadDTO
+	utils.FromJSON(r.Body, &data)
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	upload, site, ok := f.getUpload(rw, r)
+	if !ok {
+		return
+	}
+	unlock := f.uploads.Lock(upload.ID)
+	defer unlock()
+
+	fileBytes, err := f.uploads.ReadComplete(upload, data.Checksum)
+	switch {
+	case errors.Is(err, services.ErrUploadIncomplete), errors.Is(err, services.ErrUploadCommitted):
+		setUploadHeaders(rw, upload)
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, services.ErrUploadChecksum):
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, services.ErrUploadNoChecksum):
+		http.Error(rw, err.Error(), 400)
+		return
+	case err != nil:
+		f.l.Print("error reading upload ", upload.ID, " : ", err)
+		http.Error(rw, "Error reading upload", 500)
+		return
+	}
+
+	config, err := f.service.GetConfig(site)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	fileBytes, err = archive.Normalize(fileBytes, uploadLimits(site, config))
+	if err != nil {
+		archiveError(rw, err)
+		return
+	}
+	build, job, ok := f.enqueueUpload(rw, site, config, fileBytes, uuid.New())
+	if !ok {
+		return
+	}
+	err = f.uploads.Commit(upload, build.ID)
+	if errors.Is(err, services.ErrUploadCommitted) {
+		// built by another replica in the meantime. the build queued here is dropped
+		f.queue.Fail(job.ID.String(), err.Error())
+		f.builds.FinishBuild(build, services.WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		f.l.Print("error committing upload : ", err)
+	}
+
+	f.startBuild(rw, r, site, build, job, constants.BuildAction)
+}
+
+// Gets the site in the route params if it takes uploads. Writes an error response otherwise.
+func (f *SiteHandler) getUploadSite(rw http.ResponseWriter, r *http.Request) (*models.Site, bool) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return nil, false
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return nil, false
+	}
+	if site.SourceType == string(constants.GitSource) {
+		http.Error(rw, "Sites with a git source are built from their repository", 400)
+		return nil, false
+	}
+	return site, true
+}
+
+// Gets the upload in the route params with its site. Writes an error response if it isn't found.
+func (f *SiteHandler) getUpload(rw http.ResponseWriter, r *http.Request) (*models.Upload, *models.Site, bool) {
+	site, ok := f.getUploadSite(rw, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	upload, err := f.uploads.GetUpload(site.ID, mux.Vars(r)["uploadId"])
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(rw, "Upload not found", 404)
+			return nil, nil, false
+		}
+		http.Error(rw, err.Error(), 500)
+		return nil, nil, false
+	}
+	return upload, site, true
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/dtos"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/gorilla/mux"
+)
+
+// github sends payloads of up to 25MB
+const maxWebhookBody = 25 << 20
+
+// The fields of a push payload that are used. GitHub, GitLab and Gitea all send them.
+type pushEvent struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+}
+
+/*
+Enable push-to-deploy for a git site. Generates a new webhook secret, which is only
+returned in this response, so calling it again rotates the secret.
+
+The repository's webhook is set to POST /hooks/{provider}/{siteId} with the secret.
+*/
+func (f *SiteHandler) ConfigureWebhook(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	var data dtos.WebhookDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(&data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	site, err := f.service.GetSite(vars["siteId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if site == nil {
+		http.Error(rw, "Site not found", 404)
+		return
+	}
+	if site.SourceType != string(constants.GitSource) {
+		http.Error(rw, "Webhooks can only be used with git sources", 400)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(rw, "Error generating secret", 500)
+		return
+	}
+	site.WebhookSecret = hex.EncodeToString(secret)
+	site.WebhookBranch = data.Branch
+	site.AutoDeploy = data.AutoDeploy
+	f.updateSite(site, map[string]interface{}{
+		"webhook_secret": site.WebhookSecret,
+		"webhook_branch": site.WebhookBranch,
+		"auto_deploy":    site.AutoDeploy,
+	})
+
+	json.NewEncoder(rw).Encode(struct {
+		Path       string `json:"path"`
+		Secret     string `json:"secret"`
+		Branch     string `json:"branch"`
+		AutoDeploy bool   `json:"autoDeploy"`
+	}{
+		Path:       "/hooks/{provider}/" + site.ID.String(),
+		Secret:     site.WebhookSecret,
+		Branch:     site.WebhookBranch,
+		AutoDeploy: site.AutoDeploy,
+	})
+}
+
+/*
+Receives push webhooks from GitHub, GitLab and Gitea.
+
+Pushes to the site's webhook branch enqueue a build of the pushed commit. The build runs after
+the response is sent, and is deployed if the site has auto deploy on.
+*/
+func (f *SiteHandler) ReceiveWebhook(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	provider := vars["provider"]
+	if provider != constants.GitHubProvider &&
+		provider != constants.GitLabProvider &&
+		provider != constants.GiteaProvider {
+		http.Error(rw, "Unknown provider", 404)
+		return
+	}
+
+	site, err := f.service.GetSiteById(vars["siteId"])
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if site == nil || site.SourceType != string(constants.GitSource) || site.WebhookSecret == "" {
+		http.Error(rw, "Webhooks are not enabled for this site", 404)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(rw, "Error reading body", 400)
+		return
+	}
+	if !verifyWebhookSignature(provider, r.Header, body, site.WebhookSecret) {
+		http.Error(rw, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch webhookEvent(provider, r.Header) {
+	case "push":
+	case "ping":
+		rw.Write([]byte("pong"))
+		return
+	default:
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("Ignored event"))
+		return
+	}
+
+	var event pushEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(rw, "Invalid payload", 400)
+		return
+	}
+	// branch deletions have no commit to build
+	if event.Deleted || strings.Trim(event.After, "0") == "" {
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("Ignored branch deletion"))
+		return
+	}
+	if event.Ref != "refs/heads/"+site.WebhookBranch {
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("Ignored push to " + event.Ref))
+		return
+	}
+
+	build, job, err := f.enqueueGitBuild(site, event.After)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	// a site that was never deployed has to be deployed by its owner first
+	deployed := site.DeployStatus != string(constants.NotDeployed)
+	action := constants.BuildAction
+	if deployed {
+		action = constants.UpdateAction
+	}
+
+	bgJob, err := f.jobs.CreateJob(site.ID, action, &build.ID, nil)
+	if err != nil {
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	site.BuildStatus = string(constants.Building)
+	f.updateSite(site, map[string]interface{}{"build_status": site.BuildStatus})
+
+	f.jobs.Run(bgJob, func(ctx context.Context, report func(services.LogEvent)) services.WatchResult {
+		return f.runWebhookBuild(ctx, report, site, build, job, action)
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	bgJob.ToJSON(rw)
+}
+
+// Builds the pushed commit and deploys it if the site has auto deploy on
+func (f *SiteHandler) runWebhookBuild(
+	ctx context.Context,
+	report func(services.LogEvent),
+	site *models.Site,
+	build *models.Build,
+	job *models.BuildJob,
+	action constants.LastAction,
+) services.WatchResult {
+	result := f.buildSite(ctx, report, site, build, job, action)
+	if result.Status != string(constants.BuildSuccess) || !site.AutoDeploy || action != constants.UpdateAction {
+		return result
+	}
+
+	deployment, err := f.redeployBuild(ctx, site, build)
+	if err != nil {
+		f.l.Print("error updating deployment : ", err)
+		return services.WatchResult{Status: string(constants.DeploymentFailed), Reason: err.Error(), Err: err}
+	}
+	return f.watchRollout(ctx, report, site, deployment, constants.RedeployAction)
+}
+
+/*
+Points the site's deployment at the image of a build and records the rollout. The rollout is
+watched with watchRollout.
+*/
+func (f *SiteHandler) redeployBuild(ctx context.Context, site *models.Site, build *models.Build) (*models.Deployment, error) {
+	imageName := f.builds.DeployableImage(build)
+
+	deployment, err := f.deployments.CreateDeployment(build, imageName, constants.RedeployAction)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.kw.UpdateDeployment(&kuberneteswrapper.UpdateOptions{
+		Ctx:       ctx,
+		Namespace: site.Namespace,
+		Name:      site.ID.String(),
+		ImageName: imageName,
+	})
+	if err != nil {
+		result := services.WatchResult{Status: string(constants.DeploymentFailed), Reason: err.Error()}
+		f.deployments.FinishDeployment(deployment, result)
+		return nil, err
+	}
+
+	site.DeployStatus = string(constants.Deploying)
+	f.updateSite(site, map[string]interface{}{"deploy_status": site.DeployStatus})
+	return deployment, nil
+}
+
+/*
+Checks the webhook was sent by the provider with the site's secret.
+
+GitHub signs the body with HMAC-SHA256 in X-Hub-Signature-256 ("sha256=<hex>"), Gitea does the
+same in X-Gitea-Signature without the prefix, and GitLab sends the secret itself in X-Gitlab-Token.
+*/
+func verifyWebhookSignature(provider string, header http.Header, body []byte, secret string) bool {
+	switch provider {
+	case constants.GitHubProvider:
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return false
+		}
+		return validHMAC(body, secret, strings.TrimPrefix(signature, "sha256="))
+	case constants.GiteaProvider:
+		return validHMAC(body, secret, header.Get("X-Gitea-Signature"))
+	case constants.GitLabProvider:
+		token := header.Get("X-Gitlab-Token")
+		return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// Compares the hex signature with the HMAC-SHA256 of the body in constant time
+func validHMAC(body []byte, secret string, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Returns "push", "ping" or the provider's name of any other event
+func webhookEvent(provider string, header http.Header) string {
+	switch provider {
+	case constants.GitHubProvider:
+		return header.Get("X-GitHub-Event")
+	case constants.GiteaProvider:
+		return header.Get("X-Gitea-Event")
+	case constants.GitLabProvider:
+		if header.Get("X-Gitlab-Event") == "Push Hook" {
+			return "push"
+		}
+		return header.Get("X-Gitlab-Event")
+	}
+	return ""
+}
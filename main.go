@@ -2,35 +2,40 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/acme/autocert"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/certificates"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
 	"github.com/Cloudbase-Project/static-site-hosting/handlers"
 	"github.com/Cloudbase-Project/static-site-hosting/middlewares"
 	"github.com/Cloudbase-Project/static-site-hosting/models"
 	"github.com/Cloudbase-Project/static-site-hosting/services"
+	"github.com/Cloudbase-Project/static-site-hosting/storage"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
 )
 
 func main() {
 
 	logger := log.New(os.Stdout, "STATIC_SITE_HOSTING ", log.LstdFlags)
 
-	fileQueue := []string{}
-	mu := sync.Mutex{}
-
 	err := godotenv.Load()
 	if err != nil {
 		logger.Fatal("Cannot load env variables")
@@ -47,9 +52,9 @@ func main() {
 		rw.Write([]byte("hello world"))
 	})
 
-	config, err := rest.InClusterConfig()
+	config, err := kubeConfig()
 	if err != nil {
-		panic(err)
+		logger.Fatal("Cannot configure the Kubernetes client : ", err)
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
@@ -74,15 +79,69 @@ func main() {
 
 	}
 
-	db.AutoMigrate(&models.Site{}, &models.Config{})
+	db.AutoMigrate(&models.Site{}, &models.Config{}, &models.BuildJob{}, &models.Build{}, &models.Deployment{}, &models.Domain{}, &models.Certificate{}, &models.Upload{}, &models.Manifest{}, &models.ManifestFile{}, &models.Job{})
+	if err := services.MigrateDomains(db); err != nil {
+		logger.Fatal("Cannot migrate domains : ", err)
+	}
 
-	ss := services.NewSiteService(db, logger)
+	buildTimeout := utils.GetEnvDuration("BUILD_TIMEOUT", 30*time.Minute)
+	ss := services.NewSiteService(
+		db,
+		logger,
+		buildTimeout,
+		utils.GetEnvDuration("DEPLOY_TIMEOUT", 10*time.Minute),
+	)
+	qs := services.NewQueueService(
+		db,
+		logger,
+		utils.GetEnvInt("BUILD_MAX_ATTEMPTS", 3),
+		utils.GetEnvDuration("BUILD_VISIBILITY_TIMEOUT", 10*time.Minute),
+		utils.GetEnvInt("MAX_CONCURRENT_BUILDS", 0),
+	)
+	bs := services.NewBuildService(db, logger)
+	ds := services.NewDeploymentService(db, logger)
+	dms := services.NewDomainService(
+		db,
+		logger,
+		net.DefaultResolver,
+		os.Getenv("PLATFORM_DOMAIN"),
+		utils.GetEnv("CLUSTER_DOMAIN", "cluster.local"),
+	)
 	cs := services.NewConfigService(db, logger)
 	ps := services.NewProxyService(db, logger)
 
-	site := handlers.NewSiteHandler(clientset, logger, ss, &mu, &fileQueue)
-	configHandler := handlers.NewConfigHandler(logger, cs)
-	proxyHandler := handlers.NewProxyHandler(logger, ps)
+	store, err := storage.NewFromEnv()
+	if err != nil {
+		logger.Fatal("Cannot create blob store : ", err)
+	}
+	sts := services.NewStorageService(store, logger)
+	us := services.NewUploadService(
+		db,
+		logger,
+		utils.GetEnv("UPLOAD_DIR", "./uploads"),
+		utils.GetEnvDuration("UPLOAD_EXPIRY", 24*time.Hour),
+	)
+	ms := services.NewManifestService(db, logger, store)
+	js := services.NewJobService(db, logger)
+
+	site := handlers.NewSiteHandler(clientset, logger, ss, qs, bs, ds, sts, us, ms, js)
+	buildHandler := handlers.NewBuildHandler(logger, bs, ss)
+	domainHandler := handlers.NewDomainHandler(logger, dms, ss, ps)
+	configHandler := handlers.NewConfigHandler(clientset, logger, cs)
+	idle := services.NewIdleScaler(
+		db,
+		logger,
+		kuberneteswrapper.NewWrapper(clientset),
+		utils.GetEnvDuration("IDLE_TIMEOUT", 0),
+		utils.GetEnvDuration("WAKE_TIMEOUT", 5*time.Minute),
+	)
+	proxyHandler := handlers.NewProxyHandler(logger, ps, sts, idle, handlers.ProxyOptions{
+		DialTimeout:           utils.GetEnvDuration("PROXY_DIAL_TIMEOUT", 5*time.Second),
+		ResponseHeaderTimeout: utils.GetEnvDuration("PROXY_RESPONSE_HEADER_TIMEOUT", 30*time.Second),
+		IdleConnTimeout:       utils.GetEnvDuration("PROXY_IDLE_CONN_TIMEOUT", 90*time.Second),
+		MaxIdleConnsPerHost:   utils.GetEnvInt("PROXY_MAX_IDLE_CONNS_PER_HOST", 32),
+		WakeWait:              utils.GetEnvDuration("PROXY_WAKE_WAIT", 15*time.Second),
+	})
 
 	router.HandleFunc("/site/{projectId}/create", middlewares.AuthMiddleware(site.GetFileName)).
 		Methods(http.MethodPost)
@@ -118,17 +177,193 @@ func main() {
 	router.HandleFunc("/site/{projectId}/{siteId}/redeploy", middlewares.AuthMiddleware(site.RedeploySite)).
 		Methods(http.MethodPost)
 
-		// ------------------ CONFIG ROUTES
+	// replicas and resources of a site
+	router.HandleFunc("/site/{projectId}/{siteId}/scaling", middlewares.AuthMiddleware(site.UpdateScaling)).
+		Methods(http.MethodPatch)
+
+	// deployment history of a site
+	router.HandleFunc("/site/{projectId}/{siteId}/deployments", middlewares.AuthMiddleware(site.ListDeployments)).
+		Methods(http.MethodGet)
+
+	// roll back to the build of a previous deployment
+	router.HandleFunc("/site/{projectId}/{siteId}/rollback", middlewares.AuthMiddleware(site.RollbackSite)).
+		Methods(http.MethodPost)
+
+	// custom domains of a site
+	router.HandleFunc("/site/{projectId}/{siteId}/domains", middlewares.AuthMiddleware(domainHandler.AddDomain)).
+		Methods(http.MethodPost)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/domains", middlewares.AuthMiddleware(domainHandler.ListDomains)).
+		Methods(http.MethodGet)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/domains/{domainId}/verify", middlewares.AuthMiddleware(domainHandler.VerifyDomain)).
+		Methods(http.MethodPost)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/domains/{domainId}", middlewares.AuthMiddleware(domainHandler.RemoveDomain)).
+		Methods(http.MethodDelete)
+
+	// build history of a site
+	router.HandleFunc("/site/{projectId}/{siteId}/builds", middlewares.AuthMiddleware(buildHandler.ListBuilds)).
+		Methods(http.MethodGet)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/builds/{buildId}", middlewares.AuthMiddleware(buildHandler.GetBuild)).
+		Methods(http.MethodGet)
+
+	// ?follow=true streams the logs of a running build over SSE
+	router.HandleFunc("/site/{projectId}/{siteId}/builds/{buildId}/logs", middlewares.AuthMiddleware(buildHandler.GetBuildLogs)).
+		Methods(http.MethodGet)
+
+	// resumable uploads
+	router.HandleFunc("/site/{projectId}/{siteId}/uploads", middlewares.AuthMiddleware(site.CreateUpload)).
+		Methods(http.MethodPost)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/uploads/{uploadId}", middlewares.AuthMiddleware(site.GetUploadOffset)).
+		Methods(http.MethodHead)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/uploads/{uploadId}", middlewares.AuthMiddleware(site.PatchUpload)).
+		Methods(http.MethodPatch)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/uploads/{uploadId}", middlewares.AuthMiddleware(site.DeleteUpload)).
+		Methods(http.MethodDelete)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/uploads/{uploadId}/commit", middlewares.AuthMiddleware(site.CommitUpload)).
+		Methods(http.MethodPost)
+
+	// incremental deploys
+	router.HandleFunc("/site/{projectId}/{siteId}/manifests", middlewares.AuthMiddleware(site.CreateManifest)).
+		Methods(http.MethodPost)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/manifests/{manifestId}/content/{hash}", middlewares.AuthMiddleware(site.PutManifestContent)).
+		Methods(http.MethodPut)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/manifests/{manifestId}/finalize", middlewares.AuthMiddleware(site.FinalizeManifest)).
+		Methods(http.MethodPost)
+
+	// background builds and rollouts of a site
+	router.HandleFunc("/site/{projectId}/{siteId}/jobs/{jobId}", middlewares.AuthMiddleware(site.GetJob)).
+		Methods(http.MethodGet)
+
+	router.HandleFunc("/site/{projectId}/{siteId}/jobs/{jobId}/events", middlewares.AuthMiddleware(site.StreamJob)).
+		Methods(http.MethodGet)
+
+	// push-to-deploy settings of a git site
+	router.HandleFunc("/site/{projectId}/{siteId}/webhook", middlewares.AuthMiddleware(site.ConfigureWebhook)).
+		Methods(http.MethodPost)
+
+	// push webhooks from git providers. verified with the site's webhook secret
+	router.HandleFunc("/hooks/{provider}/{siteId}", site.ReceiveWebhook).Methods(http.MethodPost)
+
+	// ------------------ CONFIG ROUTES
 	router.HandleFunc("/config/", configHandler.CreateConfig).Methods(http.MethodPost)
+	router.HandleFunc("/config/{projectId}", middlewares.AuthMiddleware(configHandler.DeleteConfig)).
+		Methods(http.MethodDelete)
 
 	// router.HandleFunc("/serve/{siteId}", proxyHandler.ProxyRequest).Methods(http.MethodGet)
 	router.PathPrefix("/serve/{siteId}/").HandlerFunc(proxyHandler.ProxyRequest)
 
-	router.HandleFunc("/worker/queue/", site.GetFromQueue).Methods(http.MethodGet)
+	router.HandleFunc("/worker/queue/{jobId}", site.GetFromQueue).Methods(http.MethodGet)
+
+	// put builds abandoned by their workers back in the queue
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := qs.RequeueExpired(); err != nil {
+				logger.Print("error requeueing expired jobs : ", err)
+			}
+		}
+	}()
+
+	// fail jobs whose replica stopped while running them
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := js.FailAbandoned(); err != nil {
+				logger.Print("error failing abandoned jobs : ", err)
+			}
+		}
+	}()
+
+	// repair sites left building or deploying by jobs that were lost
+	reconciler := services.NewReconciler(
+		db,
+		logger,
+		kuberneteswrapper.NewWrapper(clientset),
+		bs,
+		ds,
+		qs,
+		js,
+		buildTimeout,
+	)
+	go reconciler.Run(context.Background(), utils.GetEnvDuration("RECONCILE_INTERVAL", time.Minute))
+
+	// scale sites without requests to zero
+	if idle.Enabled() {
+		go func() {
+			for range time.Tick(time.Minute) {
+				if err := proxyHandler.FlushRequests(); err != nil {
+					logger.Print("error recording requests : ", err)
+				}
+				if err := idle.SleepIdle(context.Background()); err != nil {
+					logger.Print("error scaling idle sites : ", err)
+				}
+			}
+		}()
+	}
+
+	// delete uploads that were abandoned before they were committed
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			if err := us.DeleteExpired(); err != nil {
+				logger.Print("error deleting expired uploads : ", err)
+			}
+		}
+	}()
+
+	var handler http.Handler = proxyHandler.HostRouter(router) // custom domains are served before the api routes
+	var tlsServer *http.Server
+
+	// issue certificates for custom domains
+	if os.Getenv("ACME_ENABLED") == "true" {
+		var cache autocert.Cache
+		if os.Getenv("CERT_STORE") == "kubernetes" {
+			cache = certificates.NewSecretCache(clientset, constants.Namespace)
+		} else {
+			cache = certificates.NewPostgresCache(db)
+		}
+
+		manager, err := certificates.NewManager(certificates.ManagerOptions{
+			DirectoryURL: os.Getenv("ACME_DIRECTORY_URL"),
+			CACertFile:   os.Getenv("ACME_CA_CERT"),
+			Email:        os.Getenv("ACME_EMAIL"),
+			Cache:        cache,
+			HostPolicy: certificates.AllowHosts(func(host string) (bool, error) {
+				site, err := ps.SiteForHost(host)
+				return site != nil, err
+			}),
+		})
+		if err != nil {
+			logger.Fatal("Cannot create ACME manager : ", err)
+		}
+
+		// HTTP-01 challenges are answered on the http port
+		handler = manager.HTTPHandler(handler)
+
+		TLS_PORT, ok := os.LookupEnv("TLS_PORT")
+		if !ok {
+			TLS_PORT = "4443"
+		}
+		tlsServer = &http.Server{
+			Addr:      ":" + TLS_PORT,
+			Handler:   proxyHandler.HostRouter(router),
+			TLSConfig: &tls.Config{GetCertificate: manager.GetCertificate, NextProtos: []string{"h2", "http/1.1"}},
+		}
+		go func() {
+			logger.Println("Starting TLS server on port : ", TLS_PORT)
+			logger.Fatal(tlsServer.ListenAndServeTLS("", ""))
+		}()
+	}
 
 	server := http.Server{
 		Addr:    ":" + PORT,
-		Handler: router,
+		Handler: handler,
 	}
 
 	// handle os signals to shutoff server
@@ -147,5 +382,26 @@ func main() {
 	defer cancel()
 
 	server.Shutdown(ctx)
+	if tlsServer != nil {
+		tlsServer.Shutdown(ctx)
+	}
+
+}
+
+/*
+Config of the Kubernetes client. In the cluster the service account of the pod is used. Outside
+of it, or when KUBECONFIG is set, the kubeconfig is loaded the way kubectl does, from KUBECONFIG
+or ~/.kube/config, with KUBE_CONTEXT picking a context other than the current one.
+*/
+func kubeConfig() (*rest.Config, error) {
+	if _, ok := os.LookupEnv("KUBECONFIG"); !ok {
+		if config, err := rest.InClusterConfig(); err == nil {
+			return config, nil
+		}
+	}
 
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: os.Getenv("KUBE_CONTEXT")},
+	).ClientConfig()
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Array of Builds
+type Builds []*Build
+
+// A single build of a site. Every upload or rebuild creates a new one.
+type Build struct {
+	ID               uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt        time.Time  `                                                       json:"createdAt"`
+	UpdatedAt        time.Time  `                                                       json:"-"`
+	SiteID           uuid.UUID  `gorm:"type:uuid;uniqueIndex:idx_site_build_number"     json:"siteId"`
+	Number           int        `gorm:"uniqueIndex:idx_site_build_number"               json:"number"`
+	ArtifactChecksum string     `                                                       json:"artifactChecksum"` // sha256 of the uploaded archive
+	GitRef           string     `                                                       json:"gitRef,omitempty"` // ref cloned for builds of git sites
+	Image            string     `                                                       json:"image"`            // tagged image name the build was pushed to
+	ImageDigest      string     `                                                       json:"imageDigest"`
+	StartedAt        *time.Time `                                                       json:"startedAt"`
+	FinishedAt       *time.Time `                                                       json:"finishedAt"`
+	Status           string     `gorm:"default:'NotBuilt'"                              json:"status"`
+	FailReason       string     `                                                       json:"failReason"`
+	Logs             string     `                                                       json:"logs,omitempty"` // logs of the kaniko pod
+}
+
+func (b *Builds) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(b)
+}
+
+func (b *Build) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(b)
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A build job in the worker queue. The kaniko init container claims the job by its id
+// and downloads the archive stored under FileName.
+type BuildJob struct {
+	ID           uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt    time.Time  `                                                       json:"createdAt"`
+	UpdatedAt    time.Time  `                                                       json:"updatedAt"`
+	SiteID       uuid.UUID  `gorm:"type:uuid;index"                                 json:"siteId"`
+	BuildID      uuid.UUID  `gorm:"type:uuid;index"                                 json:"buildId"`
+	FileName     string     `                                                       json:"fileName"`
+	State        string     `gorm:"default:'queued';index"                          json:"state"`
+	Attempts     int        `                                                       json:"attempts"`
+	MaxAttempts  int        `                                                       json:"maxAttempts"`
+	VisibleAt    time.Time  `                                                       json:"visibleAt"`    // claimed jobs become visible again after this
+	DispatchedAt *time.Time `                                                       json:"dispatchedAt"` // set while a builder pod holds a build slot for the job
+	LastError    string     `                                                       json:"lastError"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// An entry of the ACME certificate cache. Holds certificates, account keys and pending
+// HTTP-01 challenge tokens as opaque data.
+type Certificate struct {
+	Key       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Data      []byte
+}
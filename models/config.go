@@ -17,6 +17,17 @@ type Config struct {
 	ProjectId string         `                                                       json:"projectId"` // user table is controlled by cloudbase-main
 	Owner     string         `                                                       json:"owner"`
 	Enabled   bool           `                                                       json:"enabled"`
+	// quotas of a site upload, uncompressed
+	MaxUploadSize  int64 `gorm:"default:104857600" json:"maxUploadSize"`
+	MaxUploadFiles int   `gorm:"default:10000"     json:"maxUploadFiles"`
+	// limits of the project's plan on how far a site can be scaled. cpu and memory are per replica
+	MaxReplicas int    `gorm:"default:3"        json:"maxReplicas"`
+	MaxCPU      string `gorm:"default:'1'"      json:"maxCpu"`
+	MaxMemory   string `gorm:"default:'512Mi'"  json:"maxMemory"`
+	// quota of the project's namespace, on all of its sites and builds together
+	QuotaPods   int    `gorm:"default:20"       json:"quotaPods"`
+	QuotaCPU    string `gorm:"default:'4'"      json:"quotaCpu"`
+	QuotaMemory string `gorm:"default:'4Gi'"    json:"quotaMemory"`
 }
 
 func (f *Config) ToJSON(w io.Writer) error {
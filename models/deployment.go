@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Array of Deployments
+type Deployments []*Deployment
+
+// A rollout of a build of a site. Deploys, redeploys and rollbacks each record one.
+type Deployment struct {
+	ID         uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time  `                                                       json:"createdAt"`
+	UpdatedAt  time.Time  `                                                       json:"-"`
+	SiteID     uuid.UUID  `gorm:"type:uuid;index"                                 json:"siteId"`
+	BuildID    uuid.UUID  `gorm:"type:uuid"                                       json:"buildId"`
+	Image      string     `                                                       json:"image"`
+	Action     string     `                                                       json:"action"`
+	Status     string     `gorm:"default:'Deploying'"                             json:"status"`
+	FailReason string     `                                                       json:"failReason"`
+	FinishedAt *time.Time `                                                       json:"finishedAt"`
+}
+
+func (d *Deployments) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(d)
+}
+
+func (d *Deployment) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(d)
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Array of Domains
+type Domains []*Domain
+
+// A custom domain of a site. Requests with this host are served the site at the root path
+// once the domain is verified. Sites can claim the same hostname, only verified ones are unique.
+type Domain struct {
+	ID                uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"          json:"id"`
+	CreatedAt         time.Time  `                                                                json:"createdAt"`
+	UpdatedAt         time.Time  `                                                                json:"-"`
+	SiteID            uuid.UUID  `gorm:"type:uuid;index"                                          json:"siteId"`
+	Hostname          string     `gorm:"uniqueIndex:idx_domains_verified_hostname,where:verified" json:"hostname"`
+	VerificationToken string     `                                                                json:"verificationToken"`
+	Verified          bool       `                                                                json:"verified"`
+	VerifiedAt        *time.Time `                                                                json:"verifiedAt"`
+}
+
+func (d *Domains) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(d)
+}
+
+func (d *Domain) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(d)
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A build or rollout of a site running in the background. Requests that start one return
+// right away with the job, whose status is polled or streamed while it runs.
+type Job struct {
+	ID           uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt    time.Time  `                                                       json:"createdAt"`
+	UpdatedAt    time.Time  `                                                       json:"updatedAt"`
+	SiteID       uuid.UUID  `gorm:"type:uuid;index"                                 json:"siteId"`
+	Action       string     `                                                       json:"action"` // Build, Update, Deploy, Redeploy or Rollback
+	State        string     `gorm:"default:'queued';index"                          json:"state"`
+	BuildID      *uuid.UUID `gorm:"type:uuid"                                       json:"buildId,omitempty"`
+	DeploymentID *uuid.UUID `gorm:"type:uuid"                                       json:"deploymentId,omitempty"`
+	Result       string     `                                                       json:"result"` // status the build or deployment finished with
+	FailReason   string     `                                                       json:"failReason"`
+	StartedAt    *time.Time `                                                       json:"startedAt"`
+	FinishedAt   *time.Time `                                                       json:"finishedAt"`
+}
+
+func (j *Job) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(j)
+}
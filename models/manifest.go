@@ -0,0 +1,32 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A version of a site given as the content hash of every file. The files are kept in the
+// project's content addressed store, so only new content has to be uploaded.
+type Manifest struct {
+	ID        uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt time.Time      `                                                       json:"createdAt"`
+	UpdatedAt time.Time      `                                                       json:"-"`
+	SiteID    uuid.UUID      `gorm:"type:uuid;index"                                 json:"siteId"`
+	BuildID   *uuid.UUID     `gorm:"type:uuid"                                       json:"buildId"` // set once the manifest is finalized
+	Files     []ManifestFile `gorm:"foreignKey:ManifestID;constraint:OnDelete:CASCADE" json:"files"`
+}
+
+// A file of a manifest
+type ManifestFile struct {
+	ManifestID uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	Path       string    `gorm:"primaryKey"           json:"path"`
+	Hash       string    `                            json:"hash"` // sha256 of the content in hex
+}
+
+func (m *Manifest) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(m)
+}
@@ -22,6 +22,29 @@ type Site struct {
 	DeployStatus     string         `gorm:"default:'NotDeployed'"                           json:"deployStatus"`
 	DeployFailReason string         `                                                       json:"deployFailReason"`
 	LastAction       string         `gorm:"default:'Create'"                                json:"lastAction"`
+	HostingMode      string         `gorm:"default:'Container'"                             json:"hostingMode"`
+	ActiveBuildID    *uuid.UUID     `gorm:"type:uuid"                                       json:"activeBuildId"` // build served from the blob store in Storage mode
+	Preset           string         `gorm:"default:'static'"                                json:"preset"`
+	BuildCommand     string         `                                                       json:"buildCommand"` // overrides the preset's build command
+	OutputDir        string         `                                                       json:"outputDir"`    // overrides the preset's output dir
+	SourceType       string         `gorm:"default:'archive'"                               json:"sourceType"`
+	RepoURL          string         `                                                       json:"repoUrl"`
+	Ref              string         `                                                       json:"ref"`             // branch, tag or commit. the default branch when empty
+	Subdirectory     string         `                                                       json:"subdirectory"`    // directory of the repository the site is in
+	DeployKeySecret  string         `                                                       json:"deployKeySecret"` // name of the secret with the deploy key of a private repository
+	WebhookSecret    string         `                                                       json:"-"`               // signs the push webhooks of the repository
+	WebhookBranch    string         `                                                       json:"webhookBranch"`   // pushes to other branches are ignored
+	AutoDeploy       bool           `                                                       json:"autoDeploy"`      // deploy successful webhook builds
+	MinReplicas      int            `gorm:"default:1"                                       json:"minReplicas"`
+	MaxReplicas      int            `gorm:"default:1"                                       json:"maxReplicas"` // autoscaled between min and max when larger than min
+	TargetCPU        int            `gorm:"default:80"                                      json:"targetCpu"`   // cpu utilisation the autoscaler keeps, in percent of the request
+	CPURequest       string         `gorm:"default:'50m'"                                   json:"cpuRequest"`
+	CPULimit         string         `gorm:"default:'250m'"                                  json:"cpuLimit"`
+	MemoryRequest    string         `gorm:"default:'64Mi'"                                  json:"memoryRequest"`
+	MemoryLimit      string         `gorm:"default:'128Mi'"                                 json:"memoryLimit"`
+	Namespace        string         `gorm:"default:'default'"                               json:"namespace"`     // of its builders, deployment and service. sites created before projects had their own stay in default
+	Sleeping         bool           `                                                       json:"sleeping"`      // scaled to zero after being idle. woken by the next request
+	LastRequestAt    *time.Time     `                                                       json:"lastRequestAt"` // recorded by the proxy every minute
 	ConfigID         uuid.UUID
 	Config           Config
 }
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A resumable upload of a site's archive. Chunks are appended to ./uploads/<id> until
+// Offset reaches Length, and the upload is committed into a build.
+type Upload struct {
+	ID        uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt time.Time  `                                                       json:"createdAt"`
+	UpdatedAt time.Time  `                                                       json:"-"`
+	SiteID    uuid.UUID  `gorm:"type:uuid;index"                                 json:"siteId"`
+	Length    int64      `                                                       json:"length"`
+	Offset    int64      `                                                       json:"offset"`
+	Checksum  string     `                                                       json:"checksum"`  // expected sha256 of the whole upload
+	ExpiresAt time.Time  `gorm:"index"                                           json:"expiresAt"` // pushed back by every chunk
+	BuildID   *uuid.UUID `gorm:"type:uuid"                                       json:"buildId"`   // set once the upload is committed
+}
+
+func (u *Upload) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(u)
+}
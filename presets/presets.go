@@ -0,0 +1,145 @@
+package presets
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+)
+
+// How a framework's source is turned into static files.
+type Preset struct {
+	Name string
+	// image of the build stage. empty for prebuilt uploads that need no build
+	BuildImage     string
+	InstallCommand string
+	BuildCommand   string
+	// directory the build writes the site to, relative to the source root
+	OutputDir string
+}
+
+// installs node dependencies with the package manager the project's lock file belongs to
+const nodeInstall = "if [ -f yarn.lock ]; then yarn install --frozen-lockfile; " +
+	"elif [ -f package-lock.json ]; then npm ci; " +
+	"else npm install; fi"
+
+var ErrUnknownPreset = errors.New("unknown preset")
+
+var presets = map[string]Preset{
+	// an already built site. eg: the build folder of a react app
+	"static": {Name: "static", OutputDir: constants.DefaultOutputDir},
+	// plain html files at the root of the upload
+	"html": {Name: "html", OutputDir: "."},
+	"create-react-app": {
+		Name:           "create-react-app",
+		BuildImage:     "node:lts-alpine",
+		InstallCommand: nodeInstall,
+		BuildCommand:   "npm run build",
+		OutputDir:      "build",
+	},
+	"vite": {
+		Name:           "vite",
+		BuildImage:     "node:lts-alpine",
+		InstallCommand: nodeInstall,
+		BuildCommand:   "npm run build",
+		OutputDir:      "dist",
+	},
+	"vue-cli": {
+		Name:           "vue-cli",
+		BuildImage:     "node:lts-alpine",
+		InstallCommand: nodeInstall,
+		BuildCommand:   "npm run build",
+		OutputDir:      "dist",
+	},
+	// angular builds to dist/<project name>. set the output dir to match the project
+	"angular": {
+		Name:           "angular",
+		BuildImage:     "node:lts-alpine",
+		InstallCommand: nodeInstall,
+		BuildCommand:   "npx ng build --configuration production",
+		OutputDir:      "dist",
+	},
+	"hugo": {
+		Name:         "hugo",
+		BuildImage:   "klakegg/hugo:ext-alpine",
+		BuildCommand: "hugo --minify",
+		OutputDir:    "public",
+	},
+	"jekyll": {
+		Name:           "jekyll",
+		BuildImage:     "jekyll/jekyll:4",
+		InstallCommand: "if [ -f Gemfile ]; then bundle install; fi",
+		BuildCommand:   "jekyll build",
+		OutputDir:      "_site",
+	},
+}
+
+// Get a preset by name
+func Get(name string) (Preset, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return Preset{}, ErrUnknownPreset
+	}
+	return preset, nil
+}
+
+// Names of all presets
+func Names() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Returns the preset with the site's overrides applied. Empty overrides keep the preset's values.
+func (p Preset) WithOverrides(buildCommand string, outputDir string) Preset {
+	if buildCommand != "" {
+		p.BuildCommand = buildCommand
+	}
+	if outputDir != "" {
+		p.OutputDir = outputDir
+	}
+	return p
+}
+
+// Whether the preset runs a build step
+func (p Preset) NeedsBuild() bool {
+	return p.BuildImage != ""
+}
+
+/*
+Script of the build step, run in the preset's build image from the root of the source. The
+output dir is left in the source for the Dockerfile to copy.
+*/
+func (p Preset) BuildScript() string {
+	script := "set -e\n"
+	if p.InstallCommand != "" {
+		script += p.InstallCommand + "\n"
+	}
+	if p.BuildCommand != "" {
+		script += p.BuildCommand + "\n"
+	}
+	return script
+}
+
+/*
+Generates the Dockerfile for the preset. The build context is the source, already built by the
+build step, and the image serves the output dir on the given port. The build step doesn't run
+in the Dockerfile: kaniko has the registry credentials, which the site's scripts mustn't see.
+*/
+func (p Preset) Dockerfile(port string) string {
+	source := "." + path.Clean("/"+p.OutputDir)
+	if source == "./" {
+		source = "."
+	}
+
+	var b strings.Builder
+	b.WriteString("FROM node:alpine\n")
+	b.WriteString("WORKDIR /app\n")
+	b.WriteString("RUN yarn global add serve\n")
+	b.WriteString("COPY " + source + " ./site\n")
+	b.WriteString(`CMD ["serve", "-p", "` + port + `", "-s", "./site"]` + "\n")
+	return b.String()
+}
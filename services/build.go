@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containers of the image builder pod whose logs are kept with the build, in the order they run.
+// site-build is only there for presets with a build step
+var imageBuilderContainers = []string{"setup-kaniko", "site-build", "kaniko-executor"}
+
+// the containers of imageBuilderContainers the pod has
+func builderContainers(pod *corev1.Pod) []string {
+	var containers []string
+	for _, name := range imageBuilderContainers {
+		for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			if container.Name == name {
+				containers = append(containers, name)
+				break
+			}
+		}
+	}
+	return containers
+}
+
+type BuildService struct {
+	db   *gorm.DB
+	l    *log.Logger
+	logs *eventHub
+}
+
+func NewBuildService(db *gorm.DB, l *log.Logger) *BuildService {
+	return &BuildService{db: db, l: l, logs: newEventHub()}
+}
+
+// Create a new build for the site. Builds of a site are numbered from 1.
+func (bs *BuildService) CreateBuild(siteId uuid.UUID, checksum string) (*models.Build, error) {
+	return bs.CreateBuildWithID(uuid.New(), siteId, checksum)
+}
+
+// Create a new build with the given id, eg: the id a manifest was claimed for
+func (bs *BuildService) CreateBuildWithID(id uuid.UUID, siteId uuid.UUID, checksum string) (*models.Build, error) {
+	build := models.Build{
+		ID:               id,
+		SiteID:           siteId,
+		ArtifactChecksum: checksum,
+		Status:           string(constants.NotBuilt),
+	}
+
+	err := bs.db.Transaction(func(tx *gorm.DB) error {
+		// serialise numbering per site
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", siteId.String()).Error; err != nil {
+			return err
+		}
+		var last int
+		err := tx.Model(&models.Build{}).
+			Where(&models.Build{SiteID: siteId}).
+			Select("COALESCE(MAX(number), 0)").
+			Scan(&last).Error
+		if err != nil {
+			return err
+		}
+		build.Number = last + 1
+		return tx.Create(&build).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// Get all builds of a site, newest first. Logs are not included.
+func (bs *BuildService) GetAllBuilds(siteId uuid.UUID) (*models.Builds, error) {
+	var builds models.Builds
+	err := bs.db.Omit("logs").
+		Where(&models.Build{SiteID: siteId}).
+		Order("number desc").
+		Find(&builds).Error
+	if err != nil {
+		return nil, err
+	}
+	return &builds, nil
+}
+
+func (bs *BuildService) GetBuild(siteId uuid.UUID, buildId string) (*models.Build, error) {
+	var build models.Build
+	if err := bs.db.Where(&models.Build{SiteID: siteId}).First(&build, "id = ?", buildId).Error; err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// Returns the most recent build of a site.
+func (bs *BuildService) LatestBuild(siteId uuid.UUID) (*models.Build, error) {
+	var build models.Build
+	if err := bs.db.Where(&models.Build{SiteID: siteId}).Order("number desc").First(&build).Error; err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// Returns the most recent successful build of a site.
+func (bs *BuildService) LatestSuccessfulBuild(siteId uuid.UUID) (*models.Build, error) {
+	var build models.Build
+	err := bs.db.Where(&models.Build{SiteID: siteId, Status: string(constants.BuildSuccess)}).
+		Order("number desc").
+		First(&build).Error
+	if err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// Returns the image reference a deployment of the build should use. Pinned to the digest
+// when kaniko reported one, otherwise the immutable tag.
+func (bs *BuildService) DeployableImage(build *models.Build) string {
+	if build.ImageDigest != "" {
+		return utils.BuildPinnedImageName(build.SiteID.String(), build.ImageDigest)
+	}
+	return build.Image
+}
+
+func (bs *BuildService) SaveBuild(build *models.Build) {
+	bs.db.Save(build)
+}
+
+// Mark the build as started.
+func (bs *BuildService) StartBuild(build *models.Build) {
+	now := time.Now()
+	build.StartedAt = &now
+	build.Status = string(constants.Building)
+	bs.SaveBuild(build)
+}
+
+// Record the outcome of a build.
+func (bs *BuildService) FinishBuild(build *models.Build, result WatchResult) {
+	now := time.Now()
+	build.FinishedAt = &now
+	build.Status = result.Status
+	build.FailReason = result.Reason
+	build.ImageDigest = result.Digest
+	bs.SaveBuild(build)
+}
+
+// Appends the logs of the image builder pod's containers to the build.
+func (bs *BuildService) CaptureLogs(
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	namespace string,
+	podName string,
+	build *models.Build,
+) {
+	pod, err := kw.GetPod(ctx, namespace, podName)
+	if err != nil {
+		bs.l.Print("error getting logs of ", podName, " : ", err)
+		return
+	}
+	for _, container := range builderContainers(pod) {
+		logs, err := kw.GetPodLogs(ctx, namespace, podName, container)
+		if err != nil {
+			bs.l.Print("error getting logs of ", podName, "/", container, " : ", err)
+			continue
+		}
+		build.Logs += "==> " + podName + "/" + container + " <==\n" + logs + "\n"
+	}
+	bs.SaveBuild(build)
+}
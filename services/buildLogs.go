@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Start the live log stream of a build. Followers can subscribe to it until it is closed.
+func (bs *BuildService) OpenLogs(buildId uuid.UUID) {
+	bs.logs.open(buildId)
+}
+
+// Adds an event to the build's logs and sends it to followers. Phase changes save the logs so far.
+func (bs *BuildService) PublishLog(build *models.Build, event LogEvent) {
+	if event.Type == LogPhase {
+		build.Logs += "==> " + event.Data + " <==\n"
+	} else {
+		build.Logs += event.Data + "\n"
+	}
+	bs.logs.publish(build.ID, event)
+
+	if event.Type == LogPhase {
+		bs.SaveBuild(build)
+	}
+}
+
+// Ends the live log stream of a build. Followers' channels are closed.
+func (bs *BuildService) CloseLogs(buildId uuid.UUID) {
+	bs.logs.close(buildId)
+}
+
+/*
+Follow the live logs of a build. Returns the events so far and a channel of the events that
+follow, which is closed when the build finishes. stop unsubscribes.
+
+live is false if the build isn't running, in which case its logs are in the build record.
+*/
+func (bs *BuildService) FollowLogs(buildId uuid.UUID) (history []LogEvent, events <-chan LogEvent, stop func(), live bool) {
+	return bs.logs.follow(buildId)
+}
+
+/*
+Streams the logs of the image builder pod's containers line by line, in the order they run.
+Waits for each container to start before following its logs. Returns the number of lines
+streamed once the containers exit or ctx is done.
+*/
+func (bs *BuildService) StreamBuilderLogs(
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	namespace string,
+	podName string,
+	emit func(LogEvent),
+) int {
+	pod, err := kw.GetPod(ctx, namespace, podName)
+	if err != nil {
+		bs.l.Print("error streaming logs of ", podName, " : ", err)
+		return 0
+	}
+
+	lines := 0
+	for _, container := range builderContainers(pod) {
+		if !bs.waitForContainer(kw, ctx, namespace, podName, container) {
+			return lines
+		}
+		emit(LogEvent{Type: LogPhase, Container: container, Data: container + " started"})
+
+		stream, err := kw.StreamPodLogs(ctx, namespace, podName, container, true)
+		if err != nil {
+			bs.l.Print("error streaming logs of ", podName, "/", container, " : ", err)
+			continue
+		}
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			emit(LogEvent{Type: LogLine, Container: container, Data: scanner.Text()})
+			lines++
+		}
+		stream.Close()
+	}
+	return lines
+}
+
+// Polls the pod until the container is running or has exited. Returns false if the pod finished
+// without running it, eg: the kaniko container after a failed init container.
+func (bs *BuildService) waitForContainer(
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	namespace string,
+	podName string,
+	container string,
+) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		pod, err := kw.GetPod(ctx, namespace, podName)
+		if err == nil {
+			statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+			for _, status := range statuses {
+				if status.Name == container && (status.State.Running != nil || status.State.Terminated != nil) {
+					return true
+				}
+			}
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				return false
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+)
+
+func TestFollowLogs(t *testing.T) {
+	bs := NewBuildService(nil, log.New(ioutil.Discard, "", 0))
+	build := &models.Build{ID: uuid.New()}
+
+	if _, _, stop, live := bs.FollowLogs(build.ID); live {
+		t.Fatal("logs of a build that isn't running are live")
+	} else {
+		stop()
+	}
+
+	bs.OpenLogs(build.ID)
+	bs.PublishLog(build, LogEvent{Type: LogLine, Data: "before"})
+
+	history, events, stop, live := bs.FollowLogs(build.ID)
+	if !live {
+		t.Fatal("logs of a running build aren't live")
+	}
+	if len(history) != 1 || history[0].Data != "before" {
+		t.Fatalf("history = %v", history)
+	}
+
+	bs.PublishLog(build, LogEvent{Type: LogLine, Data: "after"})
+	if event := <-events; event.Data != "after" {
+		t.Fatalf("event = %v", event)
+	}
+	if build.Logs != "before\nafter\n" {
+		t.Fatalf("logs = %q", build.Logs)
+	}
+
+	// the build finishing closes the followers' channels
+	bs.CloseLogs(build.ID)
+	if _, ok := <-events; ok {
+		t.Fatal("events still open after the build finished")
+	}
+	// followers stop once the stream ends, which must not close their channel again
+	stop()
+	stop()
+
+	if _, _, _, live := bs.FollowLogs(build.ID); live {
+		t.Fatal("logs still live after the build finished")
+	}
+}
+
+func TestFollowLogsStop(t *testing.T) {
+	bs := NewBuildService(nil, log.New(ioutil.Discard, "", 0))
+	build := &models.Build{ID: uuid.New()}
+	bs.OpenLogs(build.ID)
+
+	_, events, stop, _ := bs.FollowLogs(build.ID)
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("events still open after stopping")
+	}
+
+	// followers that stopped don't get events, and closing the stream leaves them alone
+	bs.PublishLog(build, LogEvent{Type: LogLine, Data: "line"})
+	bs.CloseLogs(build.ID)
+	stop()
+}
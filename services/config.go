@@ -1,12 +1,18 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
 	"github.com/Cloudbase-Project/static-site-hosting/dtos"
 	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
 	"gorm.io/gorm"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 type ConfigService struct {
@@ -22,9 +28,15 @@ func (cs *ConfigService) CreateConfig(
 	CreateConfigDTO *dtos.CreateConfigDTO,
 ) *models.Config {
 	config := models.Config{
-		Owner:     CreateConfigDTO.Owner,
-		ProjectId: CreateConfigDTO.ProjectId,
-		Enabled:   true,
+		Owner:       CreateConfigDTO.Owner,
+		ProjectId:   CreateConfigDTO.ProjectId,
+		Enabled:     true,
+		MaxReplicas: CreateConfigDTO.MaxReplicas,
+		MaxCPU:      CreateConfigDTO.MaxCPU,
+		MaxMemory:   CreateConfigDTO.MaxMemory,
+		QuotaPods:   CreateConfigDTO.QuotaPods,
+		QuotaCPU:    CreateConfigDTO.QuotaCPU,
+		QuotaMemory: CreateConfigDTO.QuotaMemory,
 	}
 	result := cs.db.Create(&config)
 	fmt.Printf("config created: %v\n", &result)
@@ -41,3 +53,60 @@ func (cs *ConfigService) ToggleService(projectId string, ownerId string) (*model
 	cs.db.Save(&config)
 	return &config, nil
 }
+
+// Get the config of a project. Returns nil if the owner has no such project.
+func (cs *ConfigService) GetConfig(projectId string, ownerId string) (*models.Config, error) {
+	var config models.Config
+	err := cs.db.Where(&models.Config{Owner: ownerId, ProjectId: projectId}).First(&config).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+/*
+Deletes the config of a project with its sites. Their workloads go with the project's namespace,
+sites from before projects had their own namespace get theirs deleted one by one.
+*/
+func (cs *ConfigService) DeleteConfig(kw kuberneteswrapper.Interface, ctx context.Context, config *models.Config) error {
+	var sites []models.Site
+	if err := cs.db.Where("config_id = ?", config.ID).Find(&sites).Error; err != nil {
+		return err
+	}
+
+	for _, site := range sites {
+		if site.Namespace != constants.Namespace || site.HostingMode != string(constants.ContainerHosting) {
+			continue
+		}
+		siteId := site.ID.String()
+		deletes := []error{
+			kw.DeleteDeployment(&kuberneteswrapper.DeleteOptions{Ctx: ctx, Name: siteId, Namespace: site.Namespace}),
+			kw.DeleteService(&kuberneteswrapper.DeleteOptions{Ctx: ctx, Name: utils.BuildServiceName(siteId), Namespace: site.Namespace}),
+			kw.DeleteAutoscaler(ctx, site.Namespace, siteId),
+		}
+		for _, err := range deletes {
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	if err := kw.DeleteNamespace(ctx, utils.BuildProjectNamespace(config.ID.String())); err != nil {
+		return err
+	}
+
+	return cs.db.Transaction(func(tx *gorm.DB) error {
+		for _, site := range sites {
+			// free the site's custom domains
+			if err := tx.Where("site_id = ?", site.ID).Delete(&models.Domain{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("config_id = ?", config.ID).Delete(&models.Site{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(config).Error
+	})
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type DeploymentService struct {
+	db *gorm.DB
+	l  *log.Logger
+}
+
+func NewDeploymentService(db *gorm.DB, l *log.Logger) *DeploymentService {
+	return &DeploymentService{db: db, l: l}
+}
+
+// Record a new rollout of a build.
+func (ds *DeploymentService) CreateDeployment(
+	build *models.Build,
+	image string,
+	action constants.LastAction,
+) (*models.Deployment, error) {
+	deployment := models.Deployment{
+		SiteID:  build.SiteID,
+		BuildID: build.ID,
+		Image:   image,
+		Action:  string(action),
+		Status:  string(constants.Deploying),
+	}
+	if err := ds.db.Create(&deployment).Error; err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// Record the outcome of a rollout.
+func (ds *DeploymentService) FinishDeployment(deployment *models.Deployment, result WatchResult) {
+	now := time.Now()
+	deployment.FinishedAt = &now
+	deployment.Status = result.Status
+	deployment.FailReason = result.Reason
+	ds.db.Save(deployment)
+}
+
+// Get all deployments of a site, newest first.
+func (ds *DeploymentService) GetAllDeployments(siteId uuid.UUID) (*models.Deployments, error) {
+	var deployments models.Deployments
+	err := ds.db.Where(&models.Deployment{SiteID: siteId}).Order("created_at desc").Find(&deployments).Error
+	if err != nil {
+		return nil, err
+	}
+	return &deployments, nil
+}
+
+func (ds *DeploymentService) GetDeployment(siteId uuid.UUID, deploymentId string) (*models.Deployment, error) {
+	var deployment models.Deployment
+	err := ds.db.Where(&models.Deployment{SiteID: siteId}).First(&deployment, "id = ?", deploymentId).Error
+	if err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// Returns the most recent deployment of a site.
+func (ds *DeploymentService) LatestDeployment(siteId uuid.UUID) (*models.Deployment, error) {
+	var deployment models.Deployment
+	err := ds.db.Where(&models.Deployment{SiteID: siteId}).Order("created_at desc").First(&deployment).Error
+	if err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDomainTaken        = errors.New("domain is already verified by a site")
+	ErrDomainExists       = errors.New("domain is already attached to the site")
+	ErrDomainNotVerified  = errors.New("verification record not found")
+	ErrDomainInvalidInput = errors.New("invalid hostname")
+	ErrDomainReserved     = errors.New("hostname is reserved by the platform")
+)
+
+// Looks up TXT records. *net.Resolver satisfies it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type DomainService struct {
+	db       *gorm.DB
+	l        *log.Logger
+	resolver TXTResolver
+	// domains of the platform. they and their subdomains can't be attached to sites
+	reserved []string
+}
+
+func NewDomainService(db *gorm.DB, l *log.Logger, resolver TXTResolver, reserved ...string) *DomainService {
+	ds := &DomainService{db: db, l: l, resolver: resolver}
+	for _, domain := range reserved {
+		if domain = NormalizeHostname(domain); domain != "" {
+			ds.reserved = append(ds.reserved, domain)
+		}
+	}
+	return ds
+}
+
+// lowercases the hostname and removes a trailing dot and port
+func NormalizeHostname(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// Checks a normalized hostname can be attached to a site
+func (ds *DomainService) checkHostname(hostname string) error {
+	// bare labels like localhost only resolve inside the cluster
+	if hostname == "" || !strings.Contains(hostname, ".") || net.ParseIP(hostname) != nil {
+		return ErrDomainInvalidInput
+	}
+	for _, domain := range ds.reserved {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return ErrDomainReserved
+		}
+	}
+	return nil
+}
+
+/*
+Attach a domain to a site. It has to be verified before it is served. Until then it is only a
+claim: any number of sites can claim a hostname, and the first to verify it gets it.
+*/
+func (ds *DomainService) CreateDomain(siteId uuid.UUID, hostname string) (*models.Domain, error) {
+	hostname = NormalizeHostname(hostname)
+	if err := ds.checkHostname(hostname); err != nil {
+		return nil, err
+	}
+
+	var domains models.Domains
+	err := ds.db.Where("hostname = ? AND (verified OR site_id = ?)", hostname, siteId).Find(&domains).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range domains {
+		if domain.SiteID == siteId {
+			return nil, ErrDomainExists
+		}
+	}
+	if len(domains) > 0 {
+		return nil, ErrDomainTaken
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	domain := models.Domain{
+		SiteID:            siteId,
+		Hostname:          hostname,
+		VerificationToken: hex.EncodeToString(token),
+	}
+	if err := ds.db.Create(&domain).Error; err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+func (ds *DomainService) GetAllDomains(siteId uuid.UUID) (*models.Domains, error) {
+	var domains models.Domains
+	if err := ds.db.Where(&models.Domain{SiteID: siteId}).Order("created_at").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	return &domains, nil
+}
+
+func (ds *DomainService) GetDomain(siteId uuid.UUID, domainId string) (*models.Domain, error) {
+	var domain models.Domain
+	if err := ds.db.Where(&models.Domain{SiteID: siteId}).First(&domain, "id = ?", domainId).Error; err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+/*
+Checks the domain's TXT record for its verification token. Returns ErrDomainTaken if another
+site verified the hostname first.
+*/
+func (ds *DomainService) VerifyDomain(ctx context.Context, domain *models.Domain) error {
+	taken, err := ds.verifiedElsewhere(domain)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrDomainTaken
+	}
+
+	records, err := ds.resolver.LookupTXT(ctx, constants.DomainVerificationPrefix+domain.Hostname)
+	if err != nil {
+		ds.l.Print("error looking up TXT record of ", domain.Hostname, " : ", err)
+		return ErrDomainNotVerified
+	}
+
+	expected := constants.DomainVerificationKey + domain.VerificationToken
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			return ds.markVerified(domain)
+		}
+	}
+	return ErrDomainNotVerified
+}
+
+// whether a site other than the domain's verified its hostname
+func (ds *DomainService) verifiedElsewhere(domain *models.Domain) (bool, error) {
+	var count int64
+	err := ds.db.Model(&models.Domain{}).
+		Where("hostname = ? AND verified AND id <> ?", domain.Hostname, domain.ID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+/*
+Verified hostnames are unique (the partial index on hostname where verified), so of two sites
+verifying the same hostname at once only one update succeeds.
+*/
+func (ds *DomainService) markVerified(domain *models.Domain) error {
+	now := time.Now()
+	err := ds.db.Model(domain).Updates(map[string]interface{}{"verified": true, "verified_at": now}).Error
+	if err != nil {
+		if taken, _ := ds.verifiedElsewhere(domain); taken {
+			return ErrDomainTaken
+		}
+		return err
+	}
+	domain.Verified = true
+	domain.VerifiedAt = &now
+	return nil
+}
+
+// Domains used to have a unique index on hostname, which pending claims took too. Drops it.
+func MigrateDomains(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&models.Domain{}, "idx_domains_hostname") {
+		return nil
+	}
+	return db.Migrator().DropIndex(&models.Domain{}, "idx_domains_hostname")
+}
+
+func (ds *DomainService) DeleteDomain(domain *models.Domain) error {
+	return ds.db.Delete(domain).Error
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The database at TEST_POSTGRES_URI, migrated. Tests using it are skipped if it isn't set.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	uri := os.Getenv("TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("TEST_POSTGRES_URI isn't set")
+	}
+	db, err := gorm.Open(postgres.Open(uri), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Site{}, &models.Domain{}, &models.Manifest{}, &models.ManifestFile{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDomains(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TXT records by name
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := f[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+func TestCheckHostname(t *testing.T) {
+	ds := NewDomainService(nil, nil, nil, "Cloudbase.dev.", "", "cluster.local")
+
+	tests := map[string]error{
+		"www.example.com":           nil,
+		"example.com":               nil,
+		"cloudbase.dev.example.com": nil,
+		"mycloudbase.dev":           nil,
+		"":                          ErrDomainInvalidInput,
+		"localhost":                 ErrDomainInvalidInput,
+		"intranet":                  ErrDomainInvalidInput,
+		"10.0.0.1":                  ErrDomainInvalidInput,
+		"cloudbase.dev":             ErrDomainReserved,
+		"site.cloudbase.dev":        ErrDomainReserved,
+		"a.b.cloudbase.dev":         ErrDomainReserved,
+		"svc.cluster.local":         ErrDomainReserved,
+	}
+	for hostname, want := range tests {
+		if err := ds.checkHostname(hostname); err != want {
+			t.Errorf("checkHostname(%q) = %v, want %v", hostname, err, want)
+		}
+	}
+}
+
+/*
+Two sites claim the same hostname. The one without the TXT record can't take it from the
+other, and once one verifies it the other can't verify or claim it again.
+*/
+func TestDomainClaims(t *testing.T) {
+	db := newTestDB(t)
+	hostname := "claims-" + uuid.New().String() + ".example.com"
+	t.Cleanup(func() { db.Where("hostname = ?", hostname).Delete(&models.Domain{}) })
+
+	resolver := fakeResolver{}
+	ds := NewDomainService(db, log.New(ioutil.Discard, "", 0), resolver)
+	squatter, owner := uuid.New(), uuid.New()
+
+	claim, err := ds.CreateDomain(squatter, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateDomain(squatter, hostname); !errors.Is(err, ErrDomainExists) {
+		t.Errorf("second claim of a site : err = %v, want ErrDomainExists", err)
+	}
+	// a pending claim doesn't block the owner
+	domain, err := ds.CreateDomain(owner, strings.ToUpper(hostname)+".")
+	if err != nil {
+		t.Fatalf("owner couldn't claim a hostname another site claimed : %v", err)
+	}
+
+	if err := ds.VerifyDomain(context.Background(), claim); !errors.Is(err, ErrDomainNotVerified) {
+		t.Errorf("verify without the record : err = %v", err)
+	}
+	resolver[constants.DomainVerificationPrefix+hostname] = []string{constants.DomainVerificationKey + domain.VerificationToken}
+	if err := ds.VerifyDomain(context.Background(), domain); err != nil {
+		t.Fatal(err)
+	}
+	if !domain.Verified || domain.VerifiedAt == nil {
+		t.Errorf("domain wasn't marked verified : %+v", domain)
+	}
+
+	// the claim is refused even with the owner's record
+	resolver[constants.DomainVerificationPrefix+hostname] = append(resolver[constants.DomainVerificationPrefix+hostname],
+		constants.DomainVerificationKey+claim.VerificationToken)
+	if err := ds.VerifyDomain(context.Background(), claim); !errors.Is(err, ErrDomainTaken) {
+		t.Errorf("verify of a hostname another site verified : err = %v, want ErrDomainTaken", err)
+	}
+	// and so is the update if the check is raced
+	if err := ds.markVerified(claim); !errors.Is(err, ErrDomainTaken) {
+		t.Errorf("second verified row : err = %v, want ErrDomainTaken", err)
+	}
+	if _, err := ds.CreateDomain(uuid.New(), hostname); !errors.Is(err, ErrDomainTaken) {
+		t.Errorf("claim of a verified hostname : err = %v, want ErrDomainTaken", err)
+	}
+}
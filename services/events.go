@@ -0,0 +1,114 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// kinds of events of builds and jobs
+const (
+	LogLine    = "log"     // a line of a builder container's output
+	LogPhase   = "phase"   // a change of a build's phase
+	LogMessage = "message" // progress of a job, eg: its position in the build queue
+	LogStatus  = "status"  // a change of a job's state
+)
+
+// A line of a build's logs, or a change of the state of a build or job
+type LogEvent struct {
+	Type      string `json:"type"`
+	Container string `json:"container,omitempty"`
+	Data      string `json:"data"`
+}
+
+// The live events of something that is running
+type eventStream struct {
+	events      []LogEvent
+	subscribers map[chan LogEvent]bool
+}
+
+// Live event streams by id. Streams are open while what they belong to runs.
+type eventHub struct {
+	mu      sync.Mutex
+	streams map[uuid.UUID]*eventStream
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{streams: map[uuid.UUID]*eventStream{}}
+}
+
+// Starts a stream. A stream already open under the id is ended first.
+func (h *eventHub) open(id uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeLocked(id)
+	h.streams[id] = &eventStream{subscribers: map[chan LogEvent]bool{}}
+}
+
+// Sends an event to the subscribers of a stream. Subscribers that can't keep up miss events
+// rather than blocking the publisher.
+func (h *eventHub) publish(id uuid.UUID, event LogEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[id]
+	if !ok {
+		return
+	}
+	stream.events = append(stream.events, event)
+	for subscriber := range stream.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Ends a stream. Subscribers' channels are closed and they are unsubscribed, so stopping
+// afterwards does nothing.
+func (h *eventHub) close(id uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeLocked(id)
+}
+
+func (h *eventHub) closeLocked(id uuid.UUID) {
+	stream, ok := h.streams[id]
+	if !ok {
+		return
+	}
+	for subscriber := range stream.subscribers {
+		close(subscriber)
+		delete(stream.subscribers, subscriber)
+	}
+	delete(h.streams, id)
+}
+
+/*
+Subscribe to a stream. Returns the events so far and a channel of the events that follow,
+which is closed when the stream ends. stop unsubscribes.
+
+live is false if there is no such stream.
+*/
+func (h *eventHub) follow(id uuid.UUID) (history []LogEvent, events <-chan LogEvent, stop func(), live bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[id]
+	if !ok {
+		return nil, nil, func() {}, false
+	}
+
+	subscriber := make(chan LogEvent, 256)
+	stream.subscribers[subscriber] = true
+	history = append([]LogEvent(nil), stream.events...)
+
+	stop = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		// the stream may have ended, which already closed the channel
+		if h.streams[id] == stream && stream.subscribers[subscriber] {
+			delete(stream.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return history, subscriber, stop, true
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFollowJob(t *testing.T) {
+	js := &JobService{events: newEventHub()}
+	jobId := uuid.New()
+	js.events.open(jobId)
+
+	_, events, stop, live := js.FollowJob(jobId)
+	if !live {
+		t.Fatal("running job isn't live")
+	}
+	js.events.publish(jobId, LogEvent{Type: LogStatus, Data: "running"})
+	if event := <-events; event.Data != "running" {
+		t.Fatalf("event = %v", event)
+	}
+
+	// the job ending normally, then the follower's deferred stop
+	js.events.close(jobId)
+	if _, ok := <-events; ok {
+		t.Fatal("events still open after the job ended")
+	}
+	stop()
+}
+
+func TestEventHubReopen(t *testing.T) {
+	hub := newEventHub()
+	id := uuid.New()
+	hub.open(id)
+	_, old, stopOld, _ := hub.follow(id)
+
+	// opening the id again ends the followers of the old stream
+	hub.open(id)
+	if _, ok := <-old; ok {
+		t.Fatal("followers of the old stream weren't closed")
+	}
+	_, events, stop, _ := hub.follow(id)
+	stopOld()
+
+	hub.publish(id, LogEvent{Type: LogLine, Data: "line"})
+	if event := <-events; event.Data != "line" {
+		t.Fatalf("event = %v", event)
+	}
+	hub.close(id)
+	stop()
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/*
+Scales the deployments of sites without requests to zero, and back up when a request arrives.
+
+The proxy records when sites were last requested. Deployed container sites idle for longer than
+idleAfter are marked sleeping and scaled to zero. The first request to a sleeping site wakes it,
+requests that arrive while it wakes wait for the same wake up.
+*/
+type IdleScaler struct {
+	db          *gorm.DB
+	l           *log.Logger
+	kw          kuberneteswrapper.Interface
+	idleAfter   time.Duration
+	wakeTimeout time.Duration
+
+	mu     sync.Mutex
+	waking map[uuid.UUID]*wakeCall
+}
+
+// a wake up in progress. err is set before done is closed
+type wakeCall struct {
+	done chan struct{}
+	err  error
+}
+
+func NewIdleScaler(
+	db *gorm.DB,
+	l *log.Logger,
+	kw kuberneteswrapper.Interface,
+	idleAfter time.Duration,
+	wakeTimeout time.Duration,
+) *IdleScaler {
+	return &IdleScaler{
+		db:          db,
+		l:           l,
+		kw:          kw,
+		idleAfter:   idleAfter,
+		wakeTimeout: wakeTimeout,
+		waking:      map[uuid.UUID]*wakeCall{},
+	}
+}
+
+// Whether idle sites are scaled to zero
+func (s *IdleScaler) Enabled() bool {
+	return s.idleAfter > 0
+}
+
+// Saves the time sites were last requested at
+func (s *IdleScaler) RecordRequests(requests map[uuid.UUID]time.Time) error {
+	for siteId, at := range requests {
+		err := s.db.Model(&models.Site{}).
+			Where("id = ? AND (last_request_at IS NULL OR last_request_at < ?)", siteId, at).
+			UpdateColumn("last_request_at", at).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Scales the deployed container sites that weren't requested for idleAfter to zero. Sites never
+requested are idle from when they were last updated, eg: by their deployment.
+
+The site is marked sleeping before its deployment is scaled down, so requests that arrive in
+between wake it up again.
+*/
+func (s *IdleScaler) SleepIdle(ctx context.Context) error {
+	var sites []models.Site
+	err := s.db.Where(
+		"hosting_mode = ? AND deploy_status = ? AND sleeping = ? AND COALESCE(last_request_at, updated_at) < ?",
+		string(constants.ContainerHosting),
+		string(constants.Deployed),
+		false,
+		time.Now().Add(-s.idleAfter),
+	).Find(&sites).Error
+	if err != nil {
+		return err
+	}
+
+	for _, site := range sites {
+		// the site may have been requested since it was read
+		result := s.db.Model(&models.Site{}).
+			Where("id = ? AND sleeping = ? AND COALESCE(last_request_at, updated_at) < ?", site.ID, false, time.Now().Add(-s.idleAfter)).
+			UpdateColumn("sleeping", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		s.l.Print("scaling idle site ", site.ID, " to zero")
+		if err := s.kw.ScaleDeployment(ctx, site.Namespace, site.ID.String(), 0); err != nil {
+			s.l.Print("error scaling down site ", site.ID, " : ", err)
+		}
+	}
+	return nil
+}
+
+/*
+Wakes a sleeping site. Scales its deployment back up and waits for a pod to be ready before
+the site is marked awake. Returns once the site is awake, or with ctx's error if ctx is done
+first, in which case the site keeps waking up in the background.
+*/
+func (s *IdleScaler) Wake(ctx context.Context, site *models.Site) error {
+	s.mu.Lock()
+	call, ok := s.waking[site.ID]
+	if !ok {
+		call = &wakeCall{done: make(chan struct{})}
+		s.waking[site.ID] = call
+		go s.wake(site.ID, site.Namespace, SiteScaling(site).MinReplicas, call)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *IdleScaler) wake(siteId uuid.UUID, namespace string, replicas int32, call *wakeCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.wakeTimeout)
+	defer cancel()
+
+	s.l.Print("waking site ", siteId)
+	call.err = s.kw.WakeDeployment(ctx, namespace, siteId.String(), replicas)
+	if call.err == nil {
+		call.err = s.kw.WaitDeploymentReady(ctx, namespace, siteId.String())
+	}
+	if call.err == nil {
+		// the wake up counts as a request so the site isn't put back to sleep right away
+		call.err = s.db.Model(&models.Site{}).
+			Where("id = ?", siteId).
+			UpdateColumns(map[string]interface{}{"sleeping": false, "last_request_at": time.Now()}).Error
+	}
+	if call.err != nil {
+		s.l.Print("error waking site ", siteId, " : ", call.err)
+	}
+
+	s.mu.Lock()
+	delete(s.waking, siteId)
+	s.mu.Unlock()
+	close(call.done)
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Runs builds and rollouts in the background, independent of the request that started them,
+// and keeps their status.
+type JobService struct {
+	db     *gorm.DB
+	l      *log.Logger
+	events *eventHub
+}
+
+func NewJobService(db *gorm.DB, l *log.Logger) *JobService {
+	return &JobService{db: db, l: l, events: newEventHub()}
+}
+
+// A job's work. report sends progress to whoever follows the job.
+type JobTask func(ctx context.Context, report func(LogEvent)) WatchResult
+
+// Record a job of a site. buildId and deploymentId are the build and deployment the job
+// works on, if there are any yet.
+func (js *JobService) CreateJob(
+	siteId uuid.UUID,
+	action constants.LastAction,
+	buildId *uuid.UUID,
+	deploymentId *uuid.UUID,
+) (*models.Job, error) {
+	job := models.Job{
+		ID:           uuid.New(),
+		SiteID:       siteId,
+		Action:       string(action),
+		State:        string(constants.JobQueued),
+		BuildID:      buildId,
+		DeploymentID: deploymentId,
+	}
+	if err := js.db.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (js *JobService) GetJob(siteId uuid.UUID, jobId string) (*models.Job, error) {
+	var job models.Job
+	if err := js.db.Where(&models.Job{SiteID: siteId}).First(&job, "id = ?", jobId).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+/*
+Runs the task of a job in a goroutine. The job is done if the task's result is a successful
+build or deployment, and failed otherwise.
+
+The task's context isn't tied to any request, so it keeps running when the client that started
+it disconnects.
+*/
+func (js *JobService) Run(job *models.Job, task JobTask) {
+	// open the stream before returning so the job can be followed right away
+	js.events.open(job.ID)
+
+	// the caller keeps its copy to respond with
+	running := *job
+	job = &running
+
+	go func() {
+		defer js.events.close(job.ID)
+
+		report := func(event LogEvent) { js.events.publish(job.ID, event) }
+
+		now := time.Now()
+		job.StartedAt = &now
+		job.State = string(constants.JobRunning)
+		js.db.Save(job)
+		report(LogEvent{Type: LogStatus, Data: job.State})
+
+		// the heartbeat tells other replicas the job is still running
+		stop := make(chan struct{})
+		go js.heartbeat(job.ID, stop)
+		result := js.runTask(task, report)
+		close(stop)
+
+		finished := time.Now()
+		job.FinishedAt = &finished
+		job.Result = result.Status
+		job.FailReason = result.Reason
+		job.State = string(constants.JobDone)
+		if result.Err != nil ||
+			(result.Status != string(constants.BuildSuccess) && result.Status != string(constants.Deployed)) {
+			job.State = string(constants.JobFailed)
+		}
+		js.db.Save(job)
+		report(LogEvent{Type: LogStatus, Data: job.State})
+	}()
+}
+
+// a panicking task fails its job instead of taking the service down
+func (js *JobService) runTask(task JobTask, report func(LogEvent)) (result WatchResult) {
+	defer func() {
+		if err := recover(); err != nil {
+			js.l.Print("job panicked : ", err)
+			result = WatchResult{Reason: "internal error", Err: fmt.Errorf("%v", err)}
+		}
+	}()
+	return task(context.Background(), report)
+}
+
+/*
+Follow the progress of a running job. Returns the events so far and a channel of the events
+that follow, which is closed when the job finishes. stop unsubscribes.
+
+live is false if the job isn't running.
+*/
+func (js *JobService) FollowJob(jobId uuid.UUID) (history []LogEvent, events <-chan LogEvent, stop func(), live bool) {
+	return js.events.follow(jobId)
+}
+
+// Returns true if a job of the site is running on any replica
+func (js *JobService) HasActiveJob(siteId uuid.UUID) (bool, error) {
+	var count int64
+	err := js.db.Model(&models.Job{}).
+		Where("site_id = ? AND state IN ? AND updated_at >= ?",
+			siteId,
+			[]string{string(constants.JobQueued), string(constants.JobRunning)},
+			time.Now().Add(-jobAbandoned)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// how often running jobs are touched, and how long a job can go untouched before it is
+// considered abandoned
+const (
+	jobHeartbeat = time.Minute
+	jobAbandoned = 5 * time.Minute
+)
+
+func (js *JobService) heartbeat(jobId uuid.UUID, stop chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			js.db.Model(&models.Job{}).Where("id = ?", jobId).Update("updated_at", time.Now())
+		}
+	}
+}
+
+// Fails the jobs whose replica stopped while they were running. Their goroutines are gone.
+func (js *JobService) FailAbandoned() error {
+	now := time.Now()
+	result := js.db.Model(&models.Job{}).
+		Where("state IN ? AND updated_at < ?",
+			[]string{string(constants.JobQueued), string(constants.JobRunning)},
+			now.Add(-jobAbandoned)).
+		Updates(map[string]interface{}{
+			"state":       string(constants.JobFailed),
+			"fail_reason": "interrupted by a restart of the service",
+			"finished_at": now,
+		})
+	if result.RowsAffected > 0 {
+		js.l.Print("failed ", result.RowsAffected, " abandoned jobs")
+	}
+	return result.Error
+}
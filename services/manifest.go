@@ -0,0 +1,184 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/storage"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrContentHashMismatch  = errors.New("content doesn't match its hash")
+	ErrContentNotInManifest = errors.New("hash is not a file of the manifest")
+	ErrManifestFinalized    = errors.New("manifest is already finalized")
+	ErrManifestIncomplete   = errors.New("manifest has files that are not uploaded")
+)
+
+// Keeps the files of manifest deploys in a content addressed store. Files are stored once per
+// project by their sha256, so a file shared by any of the project's sites or versions is only
+// ever uploaded once.
+type ManifestService struct {
+	db    *gorm.DB
+	l     *log.Logger
+	store storage.BlobStore
+}
+
+func NewManifestService(db *gorm.DB, l *log.Logger, store storage.BlobStore) *ManifestService {
+	return &ManifestService{db: db, l: l, store: store}
+}
+
+// returns the key of a file's content in the blob store
+//
+// eg: cas/<configId>/<sha256>
+func contentKey(configId uuid.UUID, hash string) string {
+	return "cas/" + configId.String() + "/" + hash
+}
+
+// Create a manifest of path -> sha256 pairs for a site
+func (ms *ManifestService) CreateManifest(siteId uuid.UUID, files map[string]string) (*models.Manifest, error) {
+	manifest := models.Manifest{ID: uuid.New(), SiteID: siteId}
+	for path, hash := range files {
+		manifest.Files = append(manifest.Files, models.ManifestFile{ManifestID: manifest.ID, Path: path, Hash: hash})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	if err := ms.db.Create(&manifest).Error; err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (ms *ManifestService) GetManifest(siteId uuid.UUID, manifestId string) (*models.Manifest, error) {
+	var manifest models.Manifest
+	err := ms.db.Preload("Files", func(db *gorm.DB) *gorm.DB { return db.Order("path") }).
+		Where(&models.Manifest{SiteID: siteId}).
+		First(&manifest, "id = ?", manifestId).Error
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Returns the hashes of the manifest the project's store doesn't have yet
+func (ms *ManifestService) Missing(ctx context.Context, configId uuid.UUID, manifest *models.Manifest) ([]string, error) {
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, file := range manifest.Files {
+		if seen[file.Hash] {
+			continue
+		}
+		seen[file.Hash] = true
+
+		exists, err := ms.store.Exists(ctx, contentKey(configId, file.Hash))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, file.Hash)
+		}
+	}
+	return missing, nil
+}
+
+// Stores the content of a file of the manifest after checking it matches its hash. Reads at
+// most maxSize bytes.
+func (ms *ManifestService) PutContent(
+	ctx context.Context,
+	configId uuid.UUID,
+	manifest *models.Manifest,
+	hash string,
+	body io.Reader,
+	maxSize int64,
+) error {
+	if manifest.BuildID != nil {
+		return ErrManifestFinalized
+	}
+	found := false
+	for _, file := range manifest.Files {
+		if file.Hash == hash {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrContentNotInManifest
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	if int64(len(content)) > maxSize || hex.EncodeToString(sum[:]) != hash {
+		return ErrContentHashMismatch
+	}
+	return ms.store.Put(ctx, contentKey(configId, hash), bytes.NewReader(content), int64(len(content)), "")
+}
+
+// Zips the files of a manifest from the store, in the layout of the manifest's paths
+func (ms *ManifestService) Assemble(ctx context.Context, configId uuid.UUID, manifest *models.Manifest) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range manifest.Files {
+		object, err := ms.store.Get(ctx, contentKey(configId, file.Hash))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, ErrManifestIncomplete
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fh := &zip.FileHeader{Name: file.Path, Method: zip.Deflate, Modified: time.Unix(0, 0).UTC()}
+		fh.SetMode(0644)
+		w, err := zw.CreateHeader(fh)
+		if err == nil {
+			_, err = io.Copy(w, object.Body)
+		}
+		object.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Claims the manifest for the build with the given id, before the build is created. Returns
+ErrManifestFinalized if it was claimed first, eg: by a concurrent finalize on another replica.
+*/
+func (ms *ManifestService) Claim(manifest *models.Manifest, buildId uuid.UUID) error {
+	result := ms.db.Model(&models.Manifest{}).
+		Where("id = ? AND build_id IS NULL", manifest.ID).
+		Update("build_id", buildId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrManifestFinalized
+	}
+	manifest.BuildID = &buildId
+	return nil
+}
+
+// Releases the claim of a build that wasn't queued, so the manifest can be finalized again
+func (ms *ManifestService) Release(manifest *models.Manifest, buildId uuid.UUID) error {
+	manifest.BuildID = nil
+	return ms.db.Model(&models.Manifest{}).
+		Where("id = ? AND build_id = ?", manifest.ID, buildId).
+		Update("build_id", nil).Error
+}
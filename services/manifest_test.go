@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+)
+
+// Of concurrent finalizes of a manifest only one claims it
+func TestManifestClaim(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewManifestService(db, log.New(ioutil.Discard, "", 0), nil)
+
+	manifest, err := ms.CreateManifest(uuid.New(), map[string]string{"index.html": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Delete(&models.Manifest{}, "id = ?", manifest.ID) })
+
+	var wg sync.WaitGroup
+	claims := make(chan uuid.UUID, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buildId := uuid.New()
+			m := *manifest
+			err := ms.Claim(&m, buildId)
+			if err == nil {
+				claims <- buildId
+			} else if !errors.Is(err, ErrManifestFinalized) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(claims)
+	if len(claims) != 1 {
+		t.Fatalf("%v finalizes claimed the manifest, want 1", len(claims))
+	}
+	claimed := <-claims
+
+	// only the claiming build's release frees it
+	if err := ms.Release(manifest, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Claim(manifest, uuid.New()); !errors.Is(err, ErrManifestFinalized) {
+		t.Errorf("claim after another build's release : err = %v", err)
+	}
+	if err := ms.Release(manifest, claimed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Claim(manifest, uuid.New()); err != nil {
+		t.Errorf("claim after release : %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package services
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/Cloudbase-Project/static-site-hosting/models"
 	// "github.com/gofrs/uuid"
@@ -13,12 +17,110 @@ import (
 type ProxyService struct {
 	db *gorm.DB
 	l  *log.Logger
+
+	// cached host lookups, and the same entries from the newest to the oldest. the Host header
+	// is up to the client, so the cache is capped at maxHosts
+	mu       sync.Mutex
+	hosts    map[string]*list.Element
+	order    *list.List
+	maxHosts int
+}
+
+// cached lookup of a custom domain. siteId is nil for hosts that aren't a verified domain
+type hostEntry struct {
+	host    string
+	siteId  *uuid.UUID
+	expires time.Time
 }
 
+// how long host lookups are cached, and how many are
+const hostCacheTTL = 30 * time.Second
+const hostCacheSize = 10000
+
 func NewProxyService(db *gorm.DB, l *log.Logger) *ProxyService {
-	return &ProxyService{db: db, l: l}
+	return &ProxyService{
+		db:       db,
+		l:        l,
+		hosts:    map[string]*list.Element{},
+		order:    list.New(),
+		maxHosts: hostCacheSize,
+	}
+}
+
+// Get the site served at a custom domain. Returns nil if the host isn't a verified domain.
+func (ps *ProxyService) SiteForHost(host string) (*models.Site, error) {
+	host = NormalizeHostname(host)
+
+	entry, ok := ps.cachedHost(host)
+	if !ok {
+		var domain models.Domain
+		err := ps.db.Where(&models.Domain{Hostname: host, Verified: true}).First(&domain).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		entry = hostEntry{host: host, expires: time.Now().Add(hostCacheTTL)}
+		if err == nil {
+			entry.siteId = &domain.SiteID
+		}
+		ps.cacheHost(entry)
+	}
+
+	if entry.siteId == nil {
+		return nil, nil
+	}
+	return ps.VerifySite(entry.siteId.String())
+}
+
+// Drop a host from the lookup cache
+func (ps *ProxyService) ForgetHost(host string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if el, ok := ps.hosts[NormalizeHostname(host)]; ok {
+		ps.order.Remove(el)
+		delete(ps.hosts, NormalizeHostname(host))
+	}
+}
+
+// the cached lookup of a host, if it hasn't expired
+func (ps *ProxyService) cachedHost(host string) (hostEntry, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	el, ok := ps.hosts[host]
+	if !ok {
+		return hostEntry{}, false
+	}
+	entry := el.Value.(*hostEntry)
+	if time.Now().After(entry.expires) {
+		return hostEntry{}, false
+	}
+	return *entry, true
+}
+
+/*
+Caches the lookup of a host. Every lookup is cached for the same time, so entries expire from
+the oldest. The expired ones are swept as new ones come in, and the oldest are dropped once
+the cache is full.
+*/
+func (ps *ProxyService) cacheHost(entry hostEntry) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if el, ok := ps.hosts[entry.host]; ok {
+		ps.order.Remove(el)
+	}
+	ps.hosts[entry.host] = ps.order.PushFront(&entry)
+
+	now := time.Now()
+	for el := ps.order.Back(); el != nil; el = ps.order.Back() {
+		oldest := el.Value.(*hostEntry)
+		if len(ps.hosts) <= ps.maxHosts && now.Before(oldest.expires) {
+			break
+		}
+		ps.order.Remove(el)
+		delete(ps.hosts, oldest.host)
+	}
 }
 
+// Get the site a request is for. Errors if the id is invalid or no such site exists
 func (ps *ProxyService) VerifySite(siteId string) (*models.Site, error) {
 	var site models.Site
 	uniqueId, err := uuid.Parse(siteId)
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestProxyService(maxHosts int) *ProxyService {
+	ps := NewProxyService(nil, log.New(ioutil.Discard, "", 0))
+	ps.maxHosts = maxHosts
+	return ps
+}
+
+func TestHostCacheSize(t *testing.T) {
+	ps := newTestProxyService(3)
+	siteId := uuid.New()
+
+	// a flood of unknown hosts only keeps the newest
+	for i := 0; i < 100; i++ {
+		ps.cacheHost(hostEntry{host: fmt.Sprintf("random-%v.example.com", i), expires: time.Now().Add(time.Minute)})
+	}
+	ps.cacheHost(hostEntry{host: "www.example.com", siteId: &siteId, expires: time.Now().Add(time.Minute)})
+
+	if len(ps.hosts) != 3 || ps.order.Len() != 3 {
+		t.Fatalf("%v hosts cached, want 3", len(ps.hosts))
+	}
+	for _, host := range []string{"random-98.example.com", "random-99.example.com", "www.example.com"} {
+		if _, ok := ps.cachedHost(host); !ok {
+			t.Errorf("%v isn't cached", host)
+		}
+	}
+	if entry, _ := ps.cachedHost("www.example.com"); entry.siteId == nil || *entry.siteId != siteId {
+		t.Errorf("www.example.com = %v, want %v", entry.siteId, siteId)
+	}
+	if _, ok := ps.cachedHost("random-0.example.com"); ok {
+		t.Error("oldest host is still cached")
+	}
+}
+
+func TestHostCacheExpiry(t *testing.T) {
+	ps := newTestProxyService(100)
+
+	for i := 0; i < 10; i++ {
+		ps.cacheHost(hostEntry{host: fmt.Sprintf("old-%v.example.com", i), expires: time.Now().Add(-time.Second)})
+	}
+	if _, ok := ps.cachedHost("old-9.example.com"); ok {
+		t.Error("expired host was returned")
+	}
+
+	// caching a new host sweeps the expired ones
+	ps.cacheHost(hostEntry{host: "new.example.com", expires: time.Now().Add(time.Minute)})
+	if len(ps.hosts) != 1 || ps.order.Len() != 1 {
+		t.Fatalf("%v hosts cached, want 1", len(ps.hosts))
+	}
+
+	// caching a host again replaces its entry
+	ps.cacheHost(hostEntry{host: "new.example.com", expires: time.Now().Add(time.Minute)})
+	if len(ps.hosts) != 1 || ps.order.Len() != 1 {
+		t.Fatalf("%v hosts cached, want 1", len(ps.hosts))
+	}
+
+	ps.ForgetHost("NEW.example.com")
+	if len(ps.hosts) != 0 || ps.order.Len() != 0 {
+		t.Fatal("forgotten host is still cached")
+	}
+}
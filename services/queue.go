@@ -0,0 +1,239 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrJobNotClaimable = errors.New("job is not available to be claimed")
+
+// Postgres backed queue of build jobs.
+type QueueService struct {
+	db                *gorm.DB
+	l                 *log.Logger
+	maxAttempts       int
+	visibilityTimeout time.Duration
+	maxConcurrent     int
+}
+
+// key of the postgres advisory lock that serialises build slot allocation across replicas
+const buildSlotLockKey = 71830021
+
+func NewQueueService(
+	db *gorm.DB,
+	l *log.Logger,
+	maxAttempts int,
+	visibilityTimeout time.Duration,
+	maxConcurrent int,
+) *QueueService {
+	return &QueueService{
+		db:                db,
+		l:                 l,
+		maxAttempts:       maxAttempts,
+		visibilityTimeout: visibilityTimeout,
+		maxConcurrent:     maxConcurrent,
+	}
+}
+
+// Add a job for a build of the site. The archive for the job is stored at ./zipfiles/<fileName>
+func (qs *QueueService) Enqueue(siteId uuid.UUID, buildId uuid.UUID, fileName string) (*models.BuildJob, error) {
+	job := models.BuildJob{
+		ID:          uuid.New(),
+		SiteID:      siteId,
+		BuildID:     buildId,
+		FileName:    fileName,
+		State:       string(constants.JobQueued),
+		MaxAttempts: qs.maxAttempts,
+		VisibleAt:   time.Now(),
+	}
+	if job.FileName == "" {
+		job.FileName = job.ID.String() + ".zip"
+	}
+	if err := qs.db.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (qs *QueueService) GetJob(jobId string) (*models.BuildJob, error) {
+	var job models.BuildJob
+	if err := qs.db.First(&job, "id = ?", jobId).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Returns the most recent job of a site.
+func (qs *QueueService) LatestJob(siteId uuid.UUID) (*models.BuildJob, error) {
+	var job models.BuildJob
+	if err := qs.db.Where(&models.BuildJob{SiteID: siteId}).Order("created_at desc").First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Claim a job for a worker. A queued job, or a claimed/running job whose visibility timeout
+// has expired, can be claimed. The update is conditional so only one worker wins.
+func (qs *QueueService) Claim(jobId string) (*models.BuildJob, error) {
+	now := time.Now()
+	result := qs.db.Model(&models.BuildJob{}).
+		Where(
+			"id = ? AND attempts < max_attempts AND (state = ? OR (state IN ? AND visible_at < ?))",
+			jobId,
+			constants.JobQueued,
+			[]string{string(constants.JobClaimed), string(constants.JobRunning)},
+			now,
+		).
+		Updates(map[string]interface{}{
+			"state":      constants.JobClaimed,
+			"attempts":   gorm.Expr("attempts + 1"),
+			"visible_at": now.Add(qs.visibilityTimeout),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrJobNotClaimable
+	}
+	return qs.GetJob(jobId)
+}
+
+// Reserve one of the cluster wide build slots for the job. Returns false if all slots
+// are taken. A maxConcurrent of 0 or less means builds are unlimited.
+func (qs *QueueService) AcquireSlot(jobId string) (bool, error) {
+	acquired := false
+	err := qs.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", buildSlotLockKey).Error; err != nil {
+			return err
+		}
+
+		if qs.maxConcurrent > 0 {
+			var inUse int64
+			err := tx.Model(&models.BuildJob{}).
+				Where("dispatched_at IS NOT NULL AND state NOT IN ?", terminalJobStates()).
+				Count(&inUse).Error
+			if err != nil {
+				return err
+			}
+			if inUse >= int64(qs.maxConcurrent) {
+				return nil
+			}
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.BuildJob{}).
+			Where("id = ? AND dispatched_at IS NULL", jobId).
+			Updates(map[string]interface{}{"dispatched_at": now, "visible_at": now.Add(qs.visibilityTimeout)})
+		if result.Error != nil {
+			return result.Error
+		}
+		acquired = result.RowsAffected == 1
+		return nil
+	})
+	return acquired, err
+}
+
+// Number of jobs waiting for a build slot that were queued before the given job.
+func (qs *QueueService) Position(job *models.BuildJob) (int64, error) {
+	var position int64
+	err := qs.db.Model(&models.BuildJob{}).
+		Where("dispatched_at IS NULL AND state = ? AND created_at < ?", constants.JobQueued, job.CreatedAt).
+		Count(&position).Error
+	return position, err
+}
+
+// Mark a claimed job as running. Called once the worker has received the archive.
+func (qs *QueueService) MarkRunning(jobId string) error {
+	return qs.db.Model(&models.BuildJob{}).
+		Where("id = ? AND state = ?", jobId, constants.JobClaimed).
+		Updates(map[string]interface{}{
+			"state":      constants.JobRunning,
+			"visible_at": time.Now().Add(qs.visibilityTimeout),
+		}).Error
+}
+
+func (qs *QueueService) Complete(jobId string) error {
+	return qs.db.Model(&models.BuildJob{}).
+		Where("id = ?", jobId).
+		Updates(map[string]interface{}{"state": constants.JobDone, "last_error": ""}).Error
+}
+
+// Returns the job of a build
+func (qs *QueueService) JobForBuild(buildId uuid.UUID) (*models.BuildJob, error) {
+	var job models.BuildJob
+	if err := qs.db.Where(&models.BuildJob{BuildID: buildId}).First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Fail a job without retrying it, eg: when nothing is left to run it.
+func (qs *QueueService) Abandon(jobId string, reason string) error {
+	return qs.db.Model(&models.BuildJob{}).
+		Where("id = ?", jobId).
+		Updates(map[string]interface{}{
+			"state":         constants.JobFailed,
+			"last_error":    reason,
+			"dispatched_at": nil,
+		}).Error
+}
+
+// Fail a job. The job is put back in the queue if it has attempts left.
+// Returns true if the job will be retried.
+func (qs *QueueService) Fail(jobId string, reason string) (bool, error) {
+	job, err := qs.GetJob(jobId)
+	if err != nil {
+		return false, err
+	}
+	retry := job.Attempts < job.MaxAttempts
+	state := constants.JobFailed
+	if retry {
+		state = constants.JobQueued
+	}
+	// the build slot is released. a retry has to acquire a new one
+	err = qs.db.Model(job).Updates(map[string]interface{}{
+		"state":         state,
+		"last_error":    reason,
+		"visible_at":    time.Now(),
+		"dispatched_at": nil,
+	}).Error
+	return retry, err
+}
+
+// Moves claimed/running jobs whose visibility timeout expired back to the queue,
+// or fails them if they are out of attempts.
+func (qs *QueueService) RequeueExpired() error {
+	now := time.Now()
+	inFlight := []string{string(constants.JobClaimed), string(constants.JobRunning)}
+
+	err := qs.db.Model(&models.BuildJob{}).
+		Where("state IN ? AND visible_at < ? AND attempts < max_attempts", inFlight, now).
+		Updates(map[string]interface{}{
+			"state":         constants.JobQueued,
+			"last_error":    "visibility timeout",
+			"dispatched_at": nil,
+		}).Error
+	if err != nil {
+		return err
+	}
+	err = qs.db.Model(&models.BuildJob{}).
+		Where("state IN ? AND visible_at < ? AND attempts >= max_attempts", inFlight, now).
+		Updates(map[string]interface{}{"state": constants.JobFailed, "last_error": "visibility timeout"}).Error
+	if err != nil {
+		return err
+	}
+	// release slots of dispatched jobs whose worker never claimed them
+	return qs.db.Model(&models.BuildJob{}).
+		Where("state = ? AND dispatched_at IS NOT NULL AND visible_at < ?", constants.JobQueued, now).
+		Update("dispatched_at", nil).Error
+}
+
+func terminalJobStates() []string {
+	return []string{string(constants.JobDone), string(constants.JobFailed)}
+}
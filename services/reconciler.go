@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// reason of builds whose job was lost before the builder pod was created or after it was removed
+const interruptedReason = "interrupted by a restart of the service"
+
+// image builder pods younger than this are left alone, their build may not be saved yet
+const orphanGracePeriod = 2 * time.Minute
+
+/*
+Repairs what builds and rollouts leave behind when the job running them is lost, eg: when the
+service restarts in the middle of one.
+
+Sites stuck in Building or Deploying get the state of their builder pod or deployment,
+deployed sites get back a deployment, service or autoscaler that went missing, and builder pods that no
+build is waiting for are deleted.
+*/
+type Reconciler struct {
+	db           *gorm.DB
+	l            *log.Logger
+	kw           kuberneteswrapper.Interface
+	builds       *BuildService
+	deployments  *DeploymentService
+	queue        *QueueService
+	jobs         *JobService
+	buildTimeout time.Duration
+}
+
+func NewReconciler(
+	db *gorm.DB,
+	l *log.Logger,
+	kw kuberneteswrapper.Interface,
+	bs *BuildService,
+	ds *DeploymentService,
+	qs *QueueService,
+	js *JobService,
+	buildTimeout time.Duration,
+) *Reconciler {
+	return &Reconciler{
+		db:           db,
+		l:            l,
+		kw:           kw,
+		builds:       bs,
+		deployments:  ds,
+		queue:        qs,
+		jobs:         js,
+		buildTimeout: buildTimeout,
+	}
+}
+
+// Reconciles every interval until ctx is done
+func (rc *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rc.Reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// A single pass over the sites and builder pods. Errors are logged and the site is retried
+// on the next pass.
+func (rc *Reconciler) Reconcile(ctx context.Context) {
+	var building models.Sites
+	if err := rc.db.Where(&models.Site{BuildStatus: string(constants.Building)}).Find(&building).Error; err != nil {
+		rc.l.Print("reconciler : error listing building sites : ", err)
+	}
+	for _, site := range building {
+		if rc.abandoned(site) {
+			if err := rc.reconcileBuild(ctx, site); err != nil {
+				rc.l.Print("reconciler : error reconciling build of site ", site.ID, " : ", err)
+			}
+		}
+	}
+
+	var deploying models.Sites
+	if err := rc.db.Where(&models.Site{DeployStatus: string(constants.Deploying)}).Find(&deploying).Error; err != nil {
+		rc.l.Print("reconciler : error listing deploying sites : ", err)
+	}
+	for _, site := range deploying {
+		if rc.abandoned(site) {
+			if err := rc.reconcileRollout(ctx, site); err != nil {
+				rc.l.Print("reconciler : error reconciling rollout of site ", site.ID, " : ", err)
+			}
+		}
+	}
+
+	var deployed models.Sites
+	err := rc.db.Where(&models.Site{
+		DeployStatus: string(constants.Deployed),
+		HostingMode:  string(constants.ContainerHosting),
+	}).Find(&deployed).Error
+	if err != nil {
+		rc.l.Print("reconciler : error listing deployed sites : ", err)
+	}
+	for _, site := range deployed {
+		if err := rc.reconcileResources(ctx, site); err != nil {
+			rc.l.Print("reconciler : error reconciling resources of site ", site.ID, " : ", err)
+		}
+	}
+
+	if err := rc.deleteOrphanBuilders(ctx); err != nil {
+		rc.l.Print("reconciler : error deleting orphan image builders : ", err)
+	}
+}
+
+// a site is only reconciled when no job is working on it
+func (rc *Reconciler) abandoned(site *models.Site) bool {
+	active, err := rc.jobs.HasActiveJob(site.ID)
+	if err != nil {
+		rc.l.Print("reconciler : error checking jobs of site ", site.ID, " : ", err)
+		return false
+	}
+	return !active
+}
+
+/*
+Finishes the latest build of a site from its builder pod. A pod that is still running is left
+to finish unless it is past the build timeout. A build with no pod has lost its job for good.
+*/
+func (rc *Reconciler) reconcileBuild(ctx context.Context, site *models.Site) error {
+	build, err := rc.builds.LatestBuild(site.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		site.BuildStatus = string(constants.BuildFailed)
+		site.BuildFailReason = interruptedReason
+		return rc.updateSite(site, map[string]interface{}{
+			"build_status":      site.BuildStatus,
+			"build_fail_reason": site.BuildFailReason,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if build.Status == string(constants.Building) || build.Status == string(constants.NotBuilt) {
+		result, done, err := rc.builderResult(ctx, site.Namespace, build)
+		if err != nil || !done {
+			return err
+		}
+		rc.finishBuild(ctx, site.Namespace, build, result)
+	}
+
+	site.BuildStatus = build.Status
+	site.BuildFailReason = build.FailReason
+	// same as a webhook build. a deployed site has to be redeployed with the new build
+	if site.DeployStatus != string(constants.NotDeployed) && build.Status == string(constants.BuildSuccess) {
+		site.LastAction = string(constants.UpdateAction)
+		site.DeployStatus = string(constants.RedeployRequired)
+	} else {
+		site.LastAction = string(constants.BuildAction)
+	}
+	rc.l.Print("reconciler : build ", build.Number, " of site ", site.ID, " ", build.Status)
+	return rc.updateSite(site, map[string]interface{}{
+		"build_status":      site.BuildStatus,
+		"build_fail_reason": site.BuildFailReason,
+		"deploy_status":     site.DeployStatus,
+		"last_action":       site.LastAction,
+	})
+}
+
+// Reads the result of a build from its latest builder pod. done is false while the pod runs.
+func (rc *Reconciler) builderResult(
+	ctx context.Context,
+	namespace string,
+	build *models.Build,
+) (result WatchResult, done bool, err error) {
+	pods, err := rc.kw.ListBuildPods(ctx, namespace, build.ID.String())
+	if err != nil {
+		return WatchResult{}, false, err
+	}
+	if len(pods) == 0 {
+		return WatchResult{Status: string(constants.BuildFailed), Reason: interruptedReason}, true, nil
+	}
+
+	// every attempt has its own pod
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+	pod := pods[len(pods)-1]
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		return WatchResult{
+			Status:  string(constants.BuildSuccess),
+			PodName: pod.Name,
+			Digest:  imageDigest(&pod),
+		}, true, nil
+	case corev1.PodFailed:
+		return WatchResult{Status: string(constants.BuildFailed), Reason: pod.Status.Message, PodName: pod.Name}, true, nil
+	}
+
+	if build.StartedAt != nil && time.Since(*build.StartedAt) > rc.buildTimeout {
+		return WatchResult{Status: string(constants.BuildFailed), Reason: "Watch Timeout", PodName: pod.Name}, true, nil
+	}
+	return WatchResult{}, false, nil
+}
+
+// Records the result of a build whose job was lost, with the logs of its pod, and removes the pod
+func (rc *Reconciler) finishBuild(ctx context.Context, namespace string, build *models.Build, result WatchResult) {
+	if result.PodName != "" {
+		if build.Logs == "" {
+			rc.builds.CaptureLogs(rc.kw, ctx, namespace, result.PodName, build)
+		}
+		err := rc.kw.DeleteImageBuilder(&kuberneteswrapper.DeleteOptions{
+			Ctx:       ctx,
+			Name:      result.PodName,
+			Namespace: namespace,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			rc.l.Print("reconciler : error deleting image builder : ", err)
+		}
+	}
+	rc.builds.FinishBuild(build, result)
+
+	job, err := rc.queue.JobForBuild(build.ID)
+	if err != nil {
+		return
+	}
+	if result.Status == string(constants.BuildSuccess) {
+		err = rc.queue.Complete(job.ID.String())
+	} else {
+		err = rc.queue.Abandon(job.ID.String(), result.Reason)
+	}
+	if err != nil {
+		rc.l.Print("reconciler : error finishing build job : ", err)
+	}
+}
+
+// Gives a site stuck in Deploying the state of its deployment. A rollout in progress is left to
+// kubernetes, which fails it once its progress deadline passes.
+func (rc *Reconciler) reconcileRollout(ctx context.Context, site *models.Site) error {
+	var result WatchResult
+	if site.HostingMode == string(constants.StorageHosting) {
+		// activating a build is a single db update, it never stays in Deploying
+		result = WatchResult{Status: string(constants.DeploymentFailed), Reason: interruptedReason}
+	} else {
+		deployment, err := rc.kw.GetDeployment(ctx, site.Namespace, site.ID.String())
+		switch {
+		case apierrors.IsNotFound(err):
+			result = WatchResult{Status: string(constants.DeploymentFailed), Reason: "deployment not found"}
+		case err != nil:
+			return err
+		default:
+			var done bool
+			result, done = rolloutResult(deployment)
+			if !done {
+				return nil
+			}
+		}
+	}
+
+	site.DeployStatus = result.Status
+	site.DeployFailReason = result.Reason
+	site.LastAction = string(constants.DeployAction)
+
+	latest, err := rc.deployments.LatestDeployment(site.ID)
+	if err == nil {
+		if latest.Action == string(constants.RollbackAction) {
+			site.LastAction = string(constants.RollbackAction)
+		}
+		if latest.Status == string(constants.Deploying) {
+			rc.deployments.FinishDeployment(latest, result)
+		}
+	}
+	rc.l.Print("reconciler : rollout of site ", site.ID, " ", result.Status)
+	return rc.updateSite(site, map[string]interface{}{
+		"deploy_status":      site.DeployStatus,
+		"deploy_fail_reason": site.DeployFailReason,
+		"last_action":        site.LastAction,
+	})
+}
+
+// saves the status of a site the reconciler repaired, leaving edits made since it was read alone
+func (rc *Reconciler) updateSite(site *models.Site, columns map[string]interface{}) error {
+	return rc.db.Model(&models.Site{}).Where("id = ?", site.ID).Updates(columns).Error
+}
+
+// Recreates the deployment, service or autoscaler of a deployed site if it went missing
+func (rc *Reconciler) reconcileResources(ctx context.Context, site *models.Site) error {
+	label := map[string]string{"app": site.ID.String()}
+
+	_, err := rc.kw.GetDeployment(ctx, site.Namespace, site.ID.String())
+	if apierrors.IsNotFound(err) {
+		latest, err := rc.deployments.LatestDeployment(site.ID)
+		if err != nil {
+			return err
+		}
+		scaling := SiteScaling(site)
+		resources, err := scaling.Resources()
+		if err != nil {
+			return err
+		}
+		// sleeping sites stay asleep until their next request
+		replicas := scaling.MinReplicas
+		if site.Sleeping {
+			replicas = 0
+		}
+		rc.l.Print("reconciler : recreating deployment of site ", site.ID)
+		_, err = rc.kw.CreateDeployment(&kuberneteswrapper.DeploymentOptions{
+			Ctx:             ctx,
+			Namespace:       site.Namespace,
+			SiteId:          site.ID.String(),
+			DeploymentLabel: label,
+			ImageName:       latest.Image,
+			Replicas:        replicas,
+			Resources:       resources,
+		})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	_, err = rc.kw.GetService(ctx, site.Namespace, utils.BuildServiceName(site.ID.String()))
+	if apierrors.IsNotFound(err) {
+		rc.l.Print("reconciler : recreating service of site ", site.ID)
+		_, err = rc.kw.CreateService(&kuberneteswrapper.ServiceOptions{
+			Ctx:             ctx,
+			Namespace:       site.Namespace,
+			SiteId:          site.ID.String(),
+			DeploymentLabel: label,
+		})
+		if apierrors.IsAlreadyExists(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// autoscaled sites get back their autoscaler, and the others lose one they shouldn't have
+	return rc.kw.ApplyAutoscaler(ctx, site.Namespace, site.ID.String(), SiteScaling(site))
+}
+
+// Deletes builder pods whose build is finished or gone. Pods of running builds are removed by
+// their job, or by reconcileBuild once the job is lost.
+func (rc *Reconciler) deleteOrphanBuilders(ctx context.Context) error {
+	// builders run in the namespaces of the sites
+	var namespaces []string
+	if err := rc.db.Model(&models.Site{}).Distinct("namespace").Pluck("namespace", &namespaces).Error; err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		if err := rc.deleteOrphanBuildersIn(ctx, namespace); err != nil {
+			rc.l.Print("reconciler : error deleting orphan image builders in ", namespace, " : ", err)
+		}
+	}
+	return nil
+}
+
+func (rc *Reconciler) deleteOrphanBuildersIn(ctx context.Context, namespace string) error {
+	pods, err := rc.kw.ListImageBuilders(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		if time.Since(pod.CreationTimestamp.Time) < orphanGracePeriod {
+			continue
+		}
+		buildId, err := uuid.Parse(pod.Labels["build"])
+		if err == nil {
+			var build models.Build
+			err = rc.db.Select("status").First(&build, "id = ?", buildId).Error
+			if err == nil &&
+				(build.Status == string(constants.Building) || build.Status == string(constants.NotBuilt)) {
+				continue
+			}
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+
+		rc.l.Print("reconciler : deleting orphan image builder ", pod.Name)
+		err = rc.kw.DeleteImageBuilder(&kuberneteswrapper.DeleteOptions{
+			Ctx:       ctx,
+			Name:      pod.Name,
+			Namespace: namespace,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			rc.l.Print("reconciler : error deleting image builder ", pod.Name, " : ", err)
+		}
+	}
+	return nil
+}
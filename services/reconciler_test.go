@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// An autoscaled site whose autoscaler was deleted gets it back
+func TestReconcileAutoscaler(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, time.Second)
+	rc := &Reconciler{l: log.New(ioutil.Discard, "", 0), kw: kw}
+	ctx := context.Background()
+	site := &models.Site{
+		ID:            uuid.New(),
+		Namespace:     testNamespace,
+		MinReplicas:   1,
+		MaxReplicas:   3,
+		TargetCPU:     80,
+		CPURequest:    "50m",
+		CPULimit:      "250m",
+		MemoryRequest: "64Mi",
+		MemoryLimit:   "128Mi",
+	}
+	siteId := site.ID.String()
+
+	err := fs.DeploySite(kw, ctx, testNamespace, siteId, map[string]string{"app": siteId}, "image", SiteScaling(site))
+	if err != nil {
+		t.Fatalf("DeploySite: %v", err)
+	}
+	autoscalers := client.AutoscalingV1().HorizontalPodAutoscalers(testNamespace)
+	if err := autoscalers.Delete(ctx, siteId, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rc.reconcileResources(ctx, site); err != nil {
+		t.Fatalf("reconcileResources: %v", err)
+	}
+	autoscaler, err := autoscalers.Get(ctx, siteId, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("autoscaler wasn't recreated: %v", err)
+	}
+	if *autoscaler.Spec.MinReplicas != 1 || autoscaler.Spec.MaxReplicas != 3 {
+		t.Errorf("autoscaler scales between %v and %v, want 1 and 3", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas)
+	}
+
+	// sites with a fixed number of replicas don't keep one
+	site.MaxReplicas = 1
+	if err := rc.reconcileResources(ctx, site); err != nil {
+		t.Fatalf("reconcileResources: %v", err)
+	}
+	if _, err := autoscalers.Get(ctx, siteId, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("autoscaler of a site with fixed replicas: %v, want not found", err)
+	}
+}
@@ -7,33 +7,41 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
 	"github.com/Cloudbase-Project/static-site-hosting/constants"
 	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/rest"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 type SiteService struct {
 	db *gorm.DB
 	l  *log.Logger
+
+	// how long builds and rollouts are watched before they are failed
+	buildTimeout  time.Duration
+	deployTimeout time.Duration
 }
 
 type WatchResult struct {
-	Status string
-	Reason string
-	Err    error
+	Status  string
+	Reason  string
+	PodName string // name of the pod the watch observed, if any
+	Digest  string // digest of the image pushed by the image builder
+	Err     error
 }
 
-func NewSiteService(db *gorm.DB, l *log.Logger) *SiteService {
-	return &SiteService{db: db, l: l}
+func NewSiteService(db *gorm.DB, l *log.Logger, buildTimeout time.Duration, deployTimeout time.Duration) *SiteService {
+	return &SiteService{db: db, l: l, buildTimeout: buildTimeout, deployTimeout: deployTimeout}
 }
 
 func (fs *SiteService) GetAllSites(
@@ -86,10 +94,37 @@ func (fs *SiteService) GetSite(
 	return &site, nil
 }
 
+// Get a site by its id alone, for requests that aren't made by its owner. eg: webhooks.
+// Returns nil if there is no such site.
+func (fs *SiteService) GetSiteById(siteId string) (*models.Site, error) {
+	id, err := uuid.Parse(siteId)
+	if err != nil {
+		return nil, nil
+	}
+	var site models.Site
+	if err := fs.db.First(&site, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &site, nil
+}
+
+// Get the config of the project a site belongs to
+func (fs *SiteService) GetConfig(site *models.Site) (*models.Config, error) {
+	var config models.Config
+	if err := fs.db.First(&config, "id = ?", site.ConfigID).Error; err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
 // Create a site in the db.
 func (fs *SiteService) CreateSite(
 	ownerId string,
 	projectId string,
+	site models.Site,
 ) (*models.Site, error) {
 
 	var config models.Config
@@ -109,7 +144,8 @@ func (fs *SiteService) CreateSite(
 		return nil, errors.New("static-site-hosting is disabled")
 	}
 
-	site := models.Site{Config: config}
+	site.Config = config
+	site.Namespace = utils.BuildProjectNamespace(config.ID.String())
 
 	fs.db.Create(&site)
 
@@ -117,8 +153,89 @@ func (fs *SiteService) CreateSite(
 	return &site, nil
 }
 
-func (fs *SiteService) SaveSite(site *models.Site) {
-	fs.db.Save(site)
+/*
+Sets up the namespace of the site's project, where its builders and deployment run. The
+namespace is created with the project's first site, with the pull secret of the site images and
+the quota and limits of the project's plan. Later sites apply the plan again, in case it changed.
+*/
+func (fs *SiteService) SetupNamespace(kw kuberneteswrapper.Interface, ctx context.Context, site *models.Site) error {
+	if site.Namespace == constants.Namespace {
+		// a site from before projects had their own namespace
+		return nil
+	}
+	config, err := fs.GetConfig(site)
+	if err != nil {
+		return err
+	}
+
+	err = kw.CreateNamespace(
+		ctx,
+		site.Namespace,
+		map[string]string{constants.ConfigLabel: config.ID.String()},
+		map[string]string{"cloudbase.dev/project": config.ProjectId, "cloudbase.dev/owner": config.Owner},
+	)
+	if err != nil {
+		return err
+	}
+	if err := kw.CopySecret(ctx, constants.Namespace, constants.RegistrySecret, site.Namespace); err != nil {
+		return err
+	}
+	return kw.ApplyProjectLimits(ctx, site.Namespace, kuberneteswrapper.ProjectLimits{
+		Pods:            config.QuotaPods,
+		CPU:             config.QuotaCPU,
+		Memory:          config.QuotaMemory,
+		ContainerCPU:    config.MaxCPU,
+		ContainerMemory: config.MaxMemory,
+	})
+}
+
+// Saves the settings the site is built with, eg: after they are changed by an update
+func (fs *SiteService) SaveBuildSettings(site *models.Site) error {
+	return fs.UpdateSite(site.ID, map[string]interface{}{
+		"preset":            site.Preset,
+		"build_command":     site.BuildCommand,
+		"output_dir":        site.OutputDir,
+		"repo_url":          site.RepoURL,
+		"ref":               site.Ref,
+		"subdirectory":      site.Subdirectory,
+		"deploy_key_secret": site.DeployKeySecret,
+	})
+}
+
+var ErrDeployKeyNotOwned = errors.New("deploy key secret not found or not labelled for the project")
+
+/*
+Checks the site's deploy key belongs to its project. Deploy keys are secrets of the service's
+namespace, next to the registry credentials and the keys of every other project, so builds
+only use the ones labelled with the id of their site's config.
+*/
+func (fs *SiteService) CheckDeployKey(kw kuberneteswrapper.Interface, ctx context.Context, site *models.Site) error {
+	secret, err := kw.GetSecret(ctx, constants.Namespace, site.DeployKeySecret)
+	if apierrors.IsNotFound(err) {
+		return ErrDeployKeyNotOwned
+	}
+	if err != nil {
+		return err
+	}
+	if secret.Labels[constants.ConfigLabel] != site.ConfigID.String() {
+		return ErrDeployKeyNotOwned
+	}
+	return nil
+}
+
+/*
+Updates only the given columns of a site, eg: the status of a build or rollout. Jobs save their
+results this way, since a full save of the site they loaded when they started would revert the
+edits made to it while they ran.
+*/
+func (fs *SiteService) UpdateSite(siteId uuid.UUID, columns map[string]interface{}) error {
+	return fs.db.Model(&models.Site{}).Where("id = ?", siteId).Updates(columns).Error
+}
+
+// Clears the sleeping flag of a site, eg: once a new deployment of it is created with its replicas
+func (fs *SiteService) MarkAwake(site *models.Site) error {
+	site.Sleeping = false
+	return fs.db.Model(&models.Site{}).Where("id = ?", site.ID).UpdateColumn("sleeping", false).Error
 }
 
 // Delete a site with its primary key.
@@ -138,28 +255,37 @@ func (fs *SiteService) DeleteSite(siteId string, ownerId string, projectId strin
 	if err := fs.db.Where("id = ?", siteId).Delete(&models.Site{}).Error; err != nil {
 		return err
 	}
+	// free the site's custom domains
+	if err := fs.db.Where("site_id = ?", siteId).Delete(&models.Domain{}).Error; err != nil {
+		return err
+	}
 	return nil
 }
 
-// Deploys a site. Creates a deployment and a clusterIP service
+// Deploys a site. Creates a deployment, a clusterIP service and an autoscaler if the site
+// scales between a min and max number of replicas
 func (fs *SiteService) DeploySite(
-	kw *kuberneteswrapper.KubernetesWrapper,
+	kw kuberneteswrapper.Interface,
 	ctx context.Context,
 	namespace string,
 	siteId string,
 	label map[string]string,
 	imageName string,
-	replicas int32,
+	scaling kuberneteswrapper.Scaling,
 ) error {
-	// (ctx, funtionid, namespace, imagename, replicas, label)
+	resources, err := scaling.Resources()
+	if err != nil {
+		return err
+	}
 
-	_, err := kw.CreateDeployment(&kuberneteswrapper.DeploymentOptions{
+	_, err = kw.CreateDeployment(&kuberneteswrapper.DeploymentOptions{
 		Ctx:             ctx,
 		Namespace:       namespace,
 		SiteId:          siteId,
 		DeploymentLabel: label,
 		ImageName:       imageName,
-		Replicas:        replicas,
+		Replicas:        scaling.MinReplicas,
+		Resources:       resources,
 	})
 	if err != nil {
 		return err
@@ -175,128 +301,219 @@ func (fs *SiteService) DeploySite(
 	if err != nil {
 		return err
 	}
-	return nil
+	return kw.ApplyAutoscaler(ctx, namespace, siteId, scaling)
+}
+
+// Returns how the site's deployment is scaled
+func SiteScaling(site *models.Site) kuberneteswrapper.Scaling {
+	return kuberneteswrapper.Scaling{
+		MinReplicas:   int32(site.MinReplicas),
+		MaxReplicas:   int32(site.MaxReplicas),
+		TargetCPU:     int32(site.TargetCPU),
+		CPURequest:    site.CPURequest,
+		CPULimit:      site.CPULimit,
+		MemoryRequest: site.MemoryRequest,
+		MemoryLimit:   site.MemoryLimit,
+	}
 }
 
+// Applies the site's scaling to its live deployment and autoscaler. Changed resources roll out
+// new pods of the current image.
+func (fs *SiteService) ScaleSite(
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	namespace string,
+	site *models.Site,
+) error {
+	scaling := SiteScaling(site)
+	if err := kw.UpdateDeploymentScaling(ctx, namespace, site.ID.String(), scaling); err != nil {
+		return err
+	}
+	return kw.ApplyAutoscaler(ctx, namespace, site.ID.String(), scaling)
+}
+
+/*
+Returns the result of a deployment's latest rollout. done is false while it is in progress.
+
+The rollout is complete once every pod runs the latest template and is ready, ie: its readiness
+probe gets the site's index. It fails if pods can't be created or don't get ready before the
+deployment's progress deadline.
+*/
+func rolloutResult(d *appsv1.Deployment) (result WatchResult, done bool) {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	if d.Status.ObservedGeneration >= d.Generation &&
+		d.Status.UpdatedReplicas == replicas &&
+		d.Status.Replicas == replicas &&
+		d.Status.ReadyReplicas == replicas &&
+		d.Status.AvailableReplicas == replicas {
+		return WatchResult{Status: string(constants.Deployed)}, true
+	}
+
+	for _, condition := range d.Status.Conditions {
+		if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue {
+			return WatchResult{Status: string(constants.DeploymentFailed), Reason: condition.Message}, true
+		}
+		if condition.Type == appsv1.DeploymentProgressing &&
+			condition.Status == corev1.ConditionFalse &&
+			condition.Reason == "ProgressDeadlineExceeded" {
+			return WatchResult{Status: string(constants.DeploymentFailed), Reason: condition.Message}, true
+		}
+	}
+	return WatchResult{}, false
+}
+
+/*
+Watches the site's deployment until all its pods are ready or the rollout failed. Gives up with
+a "Watch Timeout" after the deploy timeout, or earlier if ctx is done.
+*/
 func (fs *SiteService) WatchDeployment(
-	kw *kuberneteswrapper.KubernetesWrapper,
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
 	site *models.Site,
 	namespace string,
 ) WatchResult {
-	watchContext, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	watchContext, cancelFunc := context.WithTimeout(ctx, fs.deployTimeout)
 	defer cancelFunc()
 
 	label, _ := kw.BuildLabel("app", []string{site.ID.String()}) // TODO:
-	deploymentWatch, err := kw.GetDeploymentWatcher(
-		watchContext,
-		label.String(),
-		namespace,
-	)
-	if err != nil {
-		return WatchResult{Err: err}
+	start := func(ctx context.Context) (watch.Interface, error) {
+		return kw.GetDeploymentWatcher(ctx, label.String(), namespace)
 	}
 
-	dataChan := make(chan WatchResult)
-
-	go func(dataChan chan WatchResult) {
-		for event := range deploymentWatch.ResultChan() {
-			p, ok := event.Object.(*appsv1.Deployment)
-			if !ok {
-				fmt.Println("unexpected type")
-				continue
-			}
-			fmt.Printf("p: %v\n", p)
-			if p.Status.UpdatedReplicas == *p.Spec.Replicas &&
-				p.Status.Replicas == *p.Spec.Replicas &&
-				p.Status.AvailableReplicas == *p.Spec.Replicas &&
-				p.Status.ObservedGeneration >= p.GetObjectMeta().GetGeneration() {
-				// deployment complete
-				fs.l.Print("Deployment available replicas = required replicas")
-				if p.Status.Conditions[0].Type == appsv1.DeploymentAvailable {
-					fs.l.Print("Deployment Available")
-				}
-				dataChan <- WatchResult{Status: string(constants.Deployed), Err: nil}
-				deploymentWatch.Stop()
-				break
-			} else if p.Status.Conditions[0].Type == appsv1.DeploymentProgressing {
-				fs.l.Print("Deployment in Progress")
-			} else if p.Status.Conditions[0].Type == appsv1.DeploymentReplicaFailure {
-				fs.l.Print("Replica failure. Reason : ", p.Status.Conditions[0].Message)
-				dataChan <- WatchResult{Status: string(constants.DeploymentFailed), Reason: p.Status.Conditions[0].Message, Err: nil}
-				fs.SaveSite(site)
-				deploymentWatch.Stop()
-				break
-
-			}
-
+	result, err := fs.watchUntil(watchContext, start, func(event watch.Event) (WatchResult, bool) {
+		d, ok := event.Object.(*appsv1.Deployment)
+		if !ok {
+			fmt.Println("unexpected type")
+			return WatchResult{}, false
+		}
+		result, done := rolloutResult(d)
+		if !done {
+			fs.l.Print("Deployment in Progress. ready replicas : ", d.Status.ReadyReplicas)
 		}
-	}(dataChan)
-
-	select {
-	case <-watchContext.Done():
-		return WatchResult{
-			Status: string(constants.DeploymentFailed),
-			Reason: "Watch Timeout",
-			Err:    nil,
+		return result, done
+	})
+	if err != nil {
+		if watchContext.Err() != nil {
+			return WatchResult{Status: string(constants.DeploymentFailed), Reason: "Watch Timeout", Err: nil}
 		}
-	case x := <-dataChan:
-		return x
+		return WatchResult{Err: err}
 	}
+	return result
 }
 
+/*
+Watches the image builder pod until it succeeds or fails. Gives up with a "Watch Timeout"
+after the build timeout, or earlier if ctx is done.
+*/
 func (fs *SiteService) WatchImageBuilder(
-	kw *kuberneteswrapper.KubernetesWrapper,
-	site *models.Site,
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	podName string,
 	namespace string,
 ) WatchResult {
-
-	// watch for 1 min and then close everything
-	watchContext, cancelFunc := context.WithTimeout(context.Background(), 60*time.Second)
+	watchContext, cancelFunc := context.WithTimeout(ctx, fs.buildTimeout)
 	defer cancelFunc()
 
-	label, _ := kw.BuildLabel("builder", []string{site.ID.String()}) // TODO:
-	podWatch, err := kw.GetImageBuilderWatcher(watchContext, label.String())
+	start := func(ctx context.Context) (watch.Interface, error) {
+		return kw.GetImageBuilderWatcher(ctx, podName, namespace)
+	}
+
+	result, err := fs.watchUntil(watchContext, start, func(event watch.Event) (WatchResult, bool) {
+		p, ok := event.Object.(*corev1.Pod)
+		if !ok {
+			fmt.Println("unexpected type")
+			return WatchResult{}, false
+		}
+		// Check Pod Phase. If its failed or succeeded.
+		switch p.Status.Phase {
+		case corev1.PodSucceeded:
+			return WatchResult{
+				Status:  string(constants.BuildSuccess),
+				Reason:  p.Status.Message,
+				PodName: p.Name,
+				Digest:  imageDigest(p),
+				Err:     nil,
+			}, true
+		case corev1.PodFailed:
+			fmt.Println("Image build failed. Reason : ", p.Status.Message)
+			return WatchResult{Status: string(constants.BuildFailed), Reason: p.Status.Message, PodName: p.Name, Err: nil}, true
+		}
+		return WatchResult{}, false
+	})
 	if err != nil {
+		if watchContext.Err() != nil {
+			return WatchResult{Status: string(constants.BuildFailed), Reason: "Watch Timeout", PodName: podName, Err: nil}
+		}
 		return WatchResult{Err: err}
 	}
+	return result
+}
 
-	dataChan := make(chan WatchResult)
+/*
+Passes the events of a watch to handle until it returns a result. The api server closes
+watches every few minutes, so the watch is started again whenever it ends. A new watch begins
+with the current state of the objects, so nothing that happened in between is missed.
+
+Returns an error if the first watch can't be started or ctx is done, even if the watch isn't
+closed with it.
+*/
+func (fs *SiteService) watchUntil(
+	ctx context.Context,
+	start func(ctx context.Context) (watch.Interface, error),
+	handle func(event watch.Event) (WatchResult, bool),
+) (WatchResult, error) {
+	w, err := start(ctx)
+	if err != nil {
+		return WatchResult{}, err
+	}
 
-	go func(dataChan chan WatchResult) {
-		for event := range podWatch.ResultChan() {
-			p, ok := event.Object.(*corev1.Pod)
-			if !ok {
-				fmt.Println("unexpected type")
-				continue
+	for {
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				w.Stop()
+				return WatchResult{}, ctx.Err()
+			case event, ok := <-w.ResultChan():
+				if !ok {
+					break events
+				}
+				if event.Type == watch.Error {
+					fs.l.Print("watch error : ", apierrors.FromObject(event.Object))
+					break events
+				}
+				if result, done := handle(event); done {
+					w.Stop()
+					return result, nil
+				}
 			}
-			// Check Pod Phase. If its failed or succeeded.
-			switch p.Status.Phase {
-			case corev1.PodSucceeded:
-				// TODO: Commit status to DB
-				dataChan <- WatchResult{Status: string(constants.BuildSuccess), Reason: p.Status.Message, Err: nil}
-				podWatch.Stop()
-				break
-			case corev1.PodFailed:
-				// TODO: Commit status to DB with message
-				fmt.Println("Image build failed. Reason : ", p.Status.Message)
-				dataChan <- WatchResult{Status: string(constants.BuildFailed), Reason: p.Status.Message, Err: nil}
-				podWatch.Stop()
+		}
+		w.Stop()
+
+		// re-establish the watch, retrying while the api server is unavailable
+		for {
+			if ctx.Err() != nil {
+				return WatchResult{}, ctx.Err()
+			}
+			w, err = start(ctx)
+			if err == nil {
 				break
 			}
+			fs.l.Print("error re-establishing watch : ", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(2 * time.Second):
+			}
 		}
-	}(dataChan)
-
-	select {
-	case <-watchContext.Done():
-		return WatchResult{Status: string(constants.BuildFailed), Reason: "Watch Timeout", Err: nil}
-	case x := <-dataChan:
-		return x
 	}
 }
 
 // Deletes the site's deployment and clusterIP service
 func (fs *SiteService) DeleteSiteResources(
-	kw *kuberneteswrapper.KubernetesWrapper,
+	kw kuberneteswrapper.Interface,
 	ctx context.Context,
 	namespace string,
 	deploymentName string,
@@ -324,11 +541,11 @@ func (fs *SiteService) DeleteSiteResources(
 	if err != nil {
 		return err
 	}
-	return nil
+	return kw.DeleteAutoscaler(ctx, namespace, deploymentName)
 }
 
 func (fs *SiteService) GetDeploymentLogs(
-	kw *kuberneteswrapper.KubernetesWrapper,
+	kw kuberneteswrapper.Interface,
 	ctx context.Context,
 	namespace string,
 	deploymentName string,
@@ -336,32 +553,17 @@ func (fs *SiteService) GetDeploymentLogs(
 	rw http.ResponseWriter,
 ) error {
 
-	label, _ := kw.BuildLabel("app", []string{deploymentName}) // TODO:
-
-	pods, err := kw.KClient.CoreV1().
-		Pods(namespace).
-		List(ctx, metav1.ListOptions{LabelSelector: label.String()})
-
-	var requests []struct {
-		Request *rest.Request
-		PodName string
-	}
-	for _, pod := range pods.Items {
-		podlog := kw.KClient.CoreV1().
-			Pods(namespace).
-			GetLogs(pod.Name, &v1.PodLogOptions{Follow: true})
-		requests = append(requests, struct {
-			Request *rest.Request
-			PodName string
-		}{Request: podlog, PodName: pod.Name})
+	pods, err := kw.ListSitePods(ctx, namespace, deploymentName)
+	if err != nil {
+		return err
 	}
 
 	wg := &sync.WaitGroup{}
-	wg.Add(len(requests))
-	for _, request := range requests {
-		go func(req *rest.Request, podName string) {
+	wg.Add(len(pods))
+	for _, pod := range pods {
+		go func(podName string) {
 			defer wg.Done()
-			stream, err := req.Stream(ctx)
+			stream, err := kw.StreamPodLogs(ctx, namespace, podName, "", true)
 			if err != nil {
 				return
 			}
@@ -386,15 +588,32 @@ func (fs *SiteService) GetDeploymentLogs(
 				}
 			}
 			return
-		}(request.Request, request.PodName)
+		}(pod.Name)
 	}
 	wg.Wait()
 	return err
 }
 
+// Deletes the image builder pod with the given name
 func (fs *SiteService) DeleteImageBuilder(
-	kw *kuberneteswrapper.KubernetesWrapper,
-	ctx context.Context, namespace string,
+	kw kuberneteswrapper.Interface,
+	ctx context.Context,
+	namespace string,
+	podName string,
 ) error {
-	return kw.KClient.CoreV1().Pods(namespace).Delete(ctx, "kaniko-worker", metav1.DeleteOptions{})
+	return kw.DeleteImageBuilder(&kuberneteswrapper.DeleteOptions{
+		Ctx:       ctx,
+		Name:      podName,
+		Namespace: namespace,
+	})
+}
+
+// Reads the image digest kaniko wrote to the termination message of the executor container
+func imageDigest(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == "kaniko-executor" && status.State.Terminated != nil {
+			return strings.TrimSpace(status.State.Terminated.Message)
+		}
+	}
+	return ""
 }
@@ -0,0 +1,559 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/static-site-hosting/KubernetesWrapper"
+	"github.com/Cloudbase-Project/static-site-hosting/constants"
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/presets"
+	"github.com/Cloudbase-Project/static-site-hosting/utils"
+	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "test"
+
+// A site service over a fake clientset. The flows tested don't touch the db.
+func newTestSiteService(t *testing.T, timeout time.Duration) (*SiteService, *fake.Clientset, kuberneteswrapper.Interface) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	l := log.New(ioutil.Discard, "", 0)
+	return NewSiteService(nil, l, timeout, timeout), client, kuberneteswrapper.NewWrapper(client)
+}
+
+/*
+Serves the watches of resource from watchers, one per watch started, and sends each watcher's
+events once it is being watched. Watches started after the last watcher fail.
+*/
+func fakeWatches(client *fake.Clientset, resource string, watchers ...[]watch.Event) {
+	var mu sync.Mutex
+	next := 0
+	client.PrependWatchReactor(resource, func(action k8stesting.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next >= len(watchers) {
+			return true, nil, errors.New("no more watches")
+		}
+		events := watchers[next]
+		next++
+
+		w := watch.NewFake()
+		go func() {
+			for _, event := range events {
+				w.Action(event.Type, event.Object)
+			}
+			// the api server closing the watch
+			w.Stop()
+		}()
+		return true, w, nil
+	})
+}
+
+func builderPod(name string, phase corev1.PodPhase, message string, statuses ...corev1.ContainerStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Status:     corev1.PodStatus{Phase: phase, Message: message, ContainerStatuses: statuses},
+	}
+}
+
+func TestCreateImageBuilder(t *testing.T) {
+	_, client, kw := newTestSiteService(t, time.Second)
+
+	_, err := kw.CreateImageBuilder(&kuberneteswrapper.ImageBuilder{
+		Ctx:        context.Background(),
+		Namespace:  testNamespace,
+		Name:       "site-build-1",
+		SiteId:     "site",
+		BuildId:    "build",
+		JobId:      "job",
+		ImageName:  "registry/site:build",
+		Dockerfile: "FROM node:alpine",
+	})
+	if err != nil {
+		t.Fatalf("creating image builder: %v", err)
+	}
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), "site-build-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting builder pod: %v", err)
+	}
+	if pod.Labels["builder"] != "site" || pod.Labels["build"] != "build" {
+		t.Errorf("labels = %v, want the site and build ids", pod.Labels)
+	}
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("restart policy = %v, want Never", pod.Spec.RestartPolicy)
+	}
+	if len(pod.Spec.InitContainers) != 1 || len(pod.Spec.Containers) != 1 {
+		t.Fatalf("want an init container and the kaniko executor, got %v and %v", pod.Spec.InitContainers, pod.Spec.Containers)
+	}
+	args := pod.Spec.Containers[0].Args
+	if !contains(args, "--destination=registry/site:build") {
+		t.Errorf("executor args %v don't push the image", args)
+	}
+
+	pods, err := kw.ListBuildPods(context.Background(), testNamespace, "build")
+	if err != nil || len(pods) != 1 {
+		t.Errorf("ListBuildPods = %v, %v, want the builder pod", len(pods), err)
+	}
+}
+
+// The site's build step runs in its own container, which can't see the registry credentials
+func TestCreateImageBuilderBuildStep(t *testing.T) {
+	_, client, kw := newTestSiteService(t, time.Second)
+
+	preset, _ := presets.Get("vite")
+	preset = preset.WithOverrides("npm run build:prod", "")
+	_, err := kw.CreateImageBuilder(&kuberneteswrapper.ImageBuilder{
+		Ctx:         context.Background(),
+		Namespace:   testNamespace,
+		Name:        "site-build-1",
+		SiteId:      "site",
+		BuildId:     "build",
+		JobId:       "job",
+		ImageName:   "registry/site:build",
+		Dockerfile:  preset.Dockerfile("4000"),
+		BuildImage:  preset.BuildImage,
+		BuildScript: preset.BuildScript(),
+	})
+	if err != nil {
+		t.Fatalf("creating image builder: %v", err)
+	}
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), "site-build-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting builder pod: %v", err)
+	}
+	if containers := builderContainers(pod); strings.Join(containers, ",") != "setup-kaniko,site-build,kaniko-executor" {
+		t.Fatalf("containers = %v, want the build step between the setup and kaniko", containers)
+	}
+	build := pod.Spec.InitContainers[1]
+	if build.Image != "node:lts-alpine" || !strings.Contains(build.Command[2], "npm run build:prod") {
+		t.Errorf("build step runs %v in %v", build.Command, build.Image)
+	}
+	if len(build.VolumeMounts) != 1 || build.VolumeMounts[0].SubPath != "src" || len(build.Env) != 0 {
+		t.Errorf("build step mounts %+v with env %v, want only the source", build.VolumeMounts, build.Env)
+	}
+	if pod.Spec.AutomountServiceAccountToken == nil || *pod.Spec.AutomountServiceAccountToken {
+		t.Error("builder pod mounts the service account token")
+	}
+	if strings.Contains(preset.Dockerfile("4000"), "npm") {
+		t.Errorf("the Dockerfile kaniko builds runs the site's scripts :\n%v", preset.Dockerfile("4000"))
+	}
+}
+
+func TestWatchImageBuilder(t *testing.T) {
+	digest := corev1.ContainerStatus{
+		Name:  "kaniko-executor",
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: "sha256:abc\n"}},
+	}
+
+	tests := []struct {
+		name    string
+		watches [][]watch.Event
+		want    WatchResult
+	}{
+		{
+			name: "success",
+			watches: [][]watch.Event{{
+				{Type: watch.Added, Object: builderPod("pod", corev1.PodPending, "")},
+				{Type: watch.Modified, Object: builderPod("pod", corev1.PodRunning, "")},
+				{Type: watch.Modified, Object: builderPod("pod", corev1.PodSucceeded, "", digest)},
+			}},
+			want: WatchResult{Status: string(constants.BuildSuccess), PodName: "pod", Digest: "sha256:abc"},
+		},
+		{
+			name: "failure",
+			watches: [][]watch.Event{{
+				{Type: watch.Added, Object: builderPod("pod", corev1.PodRunning, "")},
+				{Type: watch.Modified, Object: builderPod("pod", corev1.PodFailed, "kaniko exited with 1")},
+			}},
+			want: WatchResult{Status: string(constants.BuildFailed), Reason: "kaniko exited with 1", PodName: "pod"},
+		},
+		{
+			name: "watch closed by the api server",
+			watches: [][]watch.Event{
+				{{Type: watch.Added, Object: builderPod("pod", corev1.PodRunning, "")}},
+				{{Type: watch.Modified, Object: builderPod("pod", corev1.PodSucceeded, "", digest)}},
+			},
+			want: WatchResult{Status: string(constants.BuildSuccess), PodName: "pod", Digest: "sha256:abc"},
+		},
+		{
+			name: "error event",
+			watches: [][]watch.Event{
+				{{Type: watch.Error, Object: &metav1.Status{Message: "too old resource version"}}},
+				{{Type: watch.Modified, Object: builderPod("pod", corev1.PodFailed, "evicted")}},
+			},
+			want: WatchResult{Status: string(constants.BuildFailed), Reason: "evicted", PodName: "pod"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, client, kw := newTestSiteService(t, 10*time.Second)
+			fakeWatches(client, "pods", test.watches...)
+
+			got := fs.WatchImageBuilder(kw, context.Background(), "pod", testNamespace)
+			if got != test.want {
+				t.Errorf("WatchImageBuilder = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWatchImageBuilderTimeout(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, 100*time.Millisecond)
+	client.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		// a pod that never finishes
+		return true, watch.NewFake(), nil
+	})
+
+	got := fs.WatchImageBuilder(kw, context.Background(), "pod", testNamespace)
+	want := WatchResult{Status: string(constants.BuildFailed), Reason: "Watch Timeout", PodName: "pod"}
+	if got != want {
+		t.Errorf("WatchImageBuilder = %+v, want %+v", got, want)
+	}
+}
+
+func testScaling(min int32, max int32) kuberneteswrapper.Scaling {
+	return kuberneteswrapper.Scaling{
+		MinReplicas:   min,
+		MaxReplicas:   max,
+		TargetCPU:     80,
+		CPURequest:    "50m",
+		CPULimit:      "250m",
+		MemoryRequest: "64Mi",
+		MemoryLimit:   "128Mi",
+	}
+}
+
+func TestDeploySite(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, time.Second)
+	ctx := context.Background()
+	siteId := uuid.New().String()
+
+	err := fs.DeploySite(kw, ctx, testNamespace, siteId, map[string]string{"app": siteId}, "registry/site@sha256:abc", testScaling(2, 4))
+	if err != nil {
+		t.Fatalf("DeploySite: %v", err)
+	}
+
+	deployment, err := client.AppsV1().Deployments(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting deployment: %v", err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("replicas = %v, want the min of 2", *deployment.Spec.Replicas)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if container.Image != "registry/site@sha256:abc" {
+		t.Errorf("image = %v", container.Image)
+	}
+	if len(container.Ports) != 1 || container.Ports[0].ContainerPort != constants.SitePort {
+		t.Errorf("ports = %v, want %v", container.Ports, constants.SitePort)
+	}
+	for name, probe := range map[string]*corev1.Probe{
+		"startup":   container.StartupProbe,
+		"readiness": container.ReadinessProbe,
+		"liveness":  container.LivenessProbe,
+	} {
+		if probe == nil || probe.HTTPGet == nil {
+			t.Errorf("no http %v probe", name)
+			continue
+		}
+		if probe.HTTPGet.Path != constants.SiteIndexPath || probe.HTTPGet.Port.IntValue() != constants.SitePort {
+			t.Errorf("%v probe gets %v on %v", name, probe.HTTPGet.Path, probe.HTTPGet.Port.String())
+		}
+	}
+	if container.Resources.Limits.Memory().String() != "128Mi" {
+		t.Errorf("memory limit = %v, want 128Mi", container.Resources.Limits.Memory())
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(ctx, utils.BuildServiceName(siteId), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if port := service.Spec.Ports[0]; port.Port != constants.SitePort || port.TargetPort.IntValue() != constants.SitePort {
+		t.Errorf("service port = %v, want %v", port, constants.SitePort)
+	}
+	if service.Spec.Selector["app"] != siteId {
+		t.Errorf("service selector = %v", service.Spec.Selector)
+	}
+
+	autoscaler, err := client.AutoscalingV1().HorizontalPodAutoscalers(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting autoscaler: %v", err)
+	}
+	if *autoscaler.Spec.MinReplicas != 2 || autoscaler.Spec.MaxReplicas != 4 {
+		t.Errorf("autoscaler scales between %v and %v, want 2 and 4", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas)
+	}
+}
+
+func TestScaleSite(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, time.Second)
+	ctx := context.Background()
+	site := &models.Site{
+		ID:            uuid.New(),
+		MinReplicas:   1,
+		MaxReplicas:   3,
+		TargetCPU:     80,
+		CPURequest:    "50m",
+		CPULimit:      "250m",
+		MemoryRequest: "64Mi",
+		MemoryLimit:   "128Mi",
+	}
+	siteId := site.ID.String()
+
+	err := fs.DeploySite(kw, ctx, testNamespace, siteId, map[string]string{"app": siteId}, "image", SiteScaling(site))
+	if err != nil {
+		t.Fatalf("DeploySite: %v", err)
+	}
+
+	// a fixed number of replicas replaces the autoscaler
+	site.MinReplicas, site.MaxReplicas, site.CPULimit = 2, 2, "500m"
+	if err := fs.ScaleSite(kw, ctx, testNamespace, site); err != nil {
+		t.Fatalf("ScaleSite: %v", err)
+	}
+
+	deployment, err := client.AppsV1().Deployments(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting deployment: %v", err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("replicas = %v, want 2", *deployment.Spec.Replicas)
+	}
+	if limit := deployment.Spec.Template.Spec.Containers[0].Resources.Limits.Cpu().String(); limit != "500m" {
+		t.Errorf("cpu limit = %v, want 500m", limit)
+	}
+	_, err = client.AutoscalingV1().HorizontalPodAutoscalers(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("autoscaler of a site with fixed replicas: %v, want not found", err)
+	}
+}
+
+// A deployment with replicas out of 3 updated, ready and available
+func rolloutState(updated int32, ready int32, available int32, conditions ...appsv1.DeploymentCondition) *appsv1.Deployment {
+	replicas := int32(3)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "site", Generation: 2},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			Replicas:           3,
+			UpdatedReplicas:    updated,
+			ReadyReplicas:      ready,
+			AvailableReplicas:  available,
+			Conditions:         conditions,
+		},
+	}
+}
+
+func TestWatchDeployment(t *testing.T) {
+	deadline := appsv1.DeploymentCondition{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  corev1.ConditionFalse,
+		Reason:  "ProgressDeadlineExceeded",
+		Message: `ReplicaSet "site-1" has timed out progressing.`,
+	}
+	quota := appsv1.DeploymentCondition{
+		Type:    appsv1.DeploymentReplicaFailure,
+		Status:  corev1.ConditionTrue,
+		Message: "exceeded quota",
+	}
+
+	tests := []struct {
+		name    string
+		watches [][]watch.Event
+		want    WatchResult
+	}{
+		{
+			name: "progress until every pod is ready",
+			watches: [][]watch.Event{{
+				// no conditions yet
+				{Type: watch.Added, Object: rolloutState(0, 0, 0)},
+				{Type: watch.Modified, Object: rolloutState(3, 1, 1)},
+				// pods running but not ready
+				{Type: watch.Modified, Object: rolloutState(3, 2, 3)},
+				{Type: watch.Modified, Object: rolloutState(3, 3, 3)},
+			}},
+			want: WatchResult{Status: string(constants.Deployed)},
+		},
+		{
+			name: "progress deadline exceeded",
+			watches: [][]watch.Event{{
+				{Type: watch.Added, Object: rolloutState(1, 0, 0)},
+				{Type: watch.Modified, Object: rolloutState(1, 0, 0, deadline)},
+			}},
+			want: WatchResult{Status: string(constants.DeploymentFailed), Reason: deadline.Message},
+		},
+		{
+			name: "replica failure",
+			watches: [][]watch.Event{{
+				{Type: watch.Modified, Object: rolloutState(0, 0, 0, quota)},
+			}},
+			want: WatchResult{Status: string(constants.DeploymentFailed), Reason: "exceeded quota"},
+		},
+		{
+			name: "watch closed by the api server",
+			watches: [][]watch.Event{
+				{{Type: watch.Added, Object: rolloutState(2, 2, 2)}},
+				{{Type: watch.Modified, Object: rolloutState(3, 3, 3)}},
+			},
+			want: WatchResult{Status: string(constants.Deployed)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, client, kw := newTestSiteService(t, 10*time.Second)
+			fakeWatches(client, "deployments", test.watches...)
+
+			got := fs.WatchDeployment(kw, context.Background(), &models.Site{ID: uuid.New()}, testNamespace)
+			if got != test.want {
+				t.Errorf("WatchDeployment = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWatchDeploymentTimeout(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, 100*time.Millisecond)
+	fakeWatches(client, "deployments", []watch.Event{{Type: watch.Added, Object: rolloutState(3, 1, 1)}})
+
+	got := fs.WatchDeployment(kw, context.Background(), &models.Site{ID: uuid.New()}, testNamespace)
+	want := WatchResult{Status: string(constants.DeploymentFailed), Reason: "Watch Timeout"}
+	if got != want {
+		t.Errorf("WatchDeployment = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeleteSiteResources(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, time.Second)
+	ctx := context.Background()
+	siteId := uuid.New().String()
+
+	err := fs.DeploySite(kw, ctx, testNamespace, siteId, map[string]string{"app": siteId}, "image", testScaling(1, 2))
+	if err != nil {
+		t.Fatalf("DeploySite: %v", err)
+	}
+
+	err = fs.DeleteSiteResources(kw, ctx, testNamespace, siteId, utils.BuildServiceName(siteId))
+	if err != nil {
+		t.Fatalf("DeleteSiteResources: %v", err)
+	}
+
+	gets := map[string]func() (runtime.Object, error){
+		"deployment": func() (runtime.Object, error) {
+			return client.AppsV1().Deployments(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+		},
+		"service": func() (runtime.Object, error) {
+			return client.CoreV1().Services(testNamespace).Get(ctx, utils.BuildServiceName(siteId), metav1.GetOptions{})
+		},
+		"autoscaler": func() (runtime.Object, error) {
+			return client.AutoscalingV1().HorizontalPodAutoscalers(testNamespace).Get(ctx, siteId, metav1.GetOptions{})
+		},
+	}
+	for name, get := range gets {
+		if _, err := get(); !apierrors.IsNotFound(err) {
+			t.Errorf("%v of the deleted site: %v, want not found", name, err)
+		}
+	}
+
+	// a site without an autoscaler is deleted too
+	err = fs.DeploySite(kw, ctx, testNamespace, siteId, map[string]string{"app": siteId}, "image", testScaling(1, 1))
+	if err != nil {
+		t.Fatalf("DeploySite: %v", err)
+	}
+	if err := fs.DeleteSiteResources(kw, ctx, testNamespace, siteId, utils.BuildServiceName(siteId)); err != nil {
+		t.Errorf("DeleteSiteResources without an autoscaler: %v", err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds only use the deploy keys labelled for their project
+func TestCheckDeployKey(t *testing.T) {
+	fs, client, kw := newTestSiteService(t, time.Second)
+	site := &models.Site{ConfigID: uuid.New(), DeployKeySecret: "deploy-key"}
+
+	secret := func(name string, labels map[string]string) {
+		_, err := client.CoreV1().Secrets(constants.Namespace).Create(context.Background(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret("deploy-key", map[string]string{constants.ConfigLabel: site.ConfigID.String()})
+	secret("other-key", map[string]string{constants.ConfigLabel: uuid.New().String()})
+	secret(constants.RegistrySecret, nil)
+
+	if err := fs.CheckDeployKey(kw, context.Background(), site); err != nil {
+		t.Errorf("project's key refused : %v", err)
+	}
+	for _, name := range []string{"other-key", constants.RegistrySecret, "missing"} {
+		site.DeployKeySecret = name
+		if err := fs.CheckDeployKey(kw, context.Background(), site); !errors.Is(err, ErrDeployKeyNotOwned) {
+			t.Errorf("CheckDeployKey(%v) = %v, want ErrDeployKeyNotOwned", name, err)
+		}
+	}
+}
+
+// Changed build settings are saved, without reverting the status a build saved meanwhile
+func TestSaveBuildSettings(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewSiteService(db, log.New(ioutil.Discard, "", 0), time.Second, time.Second)
+
+	site := models.Site{SourceType: string(constants.GitSource), RepoURL: "https://example.com/old.git"}
+	if err := db.Create(&site).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Unscoped().Delete(&models.Site{}, "id = ?", site.ID) })
+
+	if err := fs.UpdateSite(site.ID, map[string]interface{}{"build_status": string(constants.Building)}); err != nil {
+		t.Fatal(err)
+	}
+	site.Preset = "vite"
+	site.BuildCommand = "npm run build:prod"
+	site.OutputDir = "out"
+	site.RepoURL = "https://example.com/new.git"
+	site.Ref = "v2"
+	site.Subdirectory = "web"
+	site.DeployKeySecret = "deploy-key"
+	if err := fs.SaveBuildSettings(&site); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved models.Site
+	if err := db.First(&saved, "id = ?", site.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.Preset != "vite" || saved.BuildCommand != "npm run build:prod" || saved.OutputDir != "out" ||
+		saved.RepoURL != "https://example.com/new.git" || saved.Ref != "v2" || saved.Subdirectory != "web" ||
+		saved.DeployKeySecret != "deploy-key" {
+		t.Errorf("saved settings = %+v", saved)
+	}
+	if saved.BuildStatus != string(constants.Building) {
+		t.Errorf("build status = %v, the settings save reverted it", saved.BuildStatus)
+	}
+}
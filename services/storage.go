@@ -0,0 +1,121 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"log"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/Cloudbase-Project/static-site-hosting/storage"
+)
+
+// Publishes and serves the files of sites hosted in Storage mode.
+type StorageService struct {
+	store storage.BlobStore
+	l     *log.Logger
+}
+
+func NewStorageService(store storage.BlobStore, l *log.Logger) *StorageService {
+	return &StorageService{store: store, l: l}
+}
+
+// returns the key prefix of a build's files in the blob store
+//
+// eg: sites/<siteId>/<buildId>/
+func buildPrefix(siteId string, buildId string) string {
+	return "sites/" + siteId + "/" + buildId + "/"
+}
+
+// Extracts the archive of a build into the blob store. Only files under outputDir are published,
+// unless the archive has nothing under it, in which case the whole archive is the site.
+// Returns the number of files published.
+func (ss *StorageService) Publish(
+	ctx context.Context,
+	build *models.Build,
+	archivePath string,
+	outputDir string,
+) (int, error) {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// "." publishes the whole archive
+	root := strings.TrimPrefix(path.Clean("/"+outputDir), "/")
+	if root != "" {
+		root += "/"
+	}
+	hasRoot := false
+	for _, file := range reader.File {
+		if strings.HasPrefix(file.Name, root) {
+			hasRoot = true
+			break
+		}
+	}
+	if !hasRoot {
+		root = ""
+	}
+
+	prefix := buildPrefix(build.SiteID.String(), build.ID.String())
+	published := 0
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || !strings.HasPrefix(file.Name, root) {
+			continue
+		}
+		name := path.Clean("/" + strings.TrimPrefix(file.Name, root))
+		if name == "/" {
+			continue
+		}
+
+		body, err := file.Open()
+		if err != nil {
+			return published, err
+		}
+		err = ss.store.Put(
+			ctx,
+			prefix+strings.TrimPrefix(name, "/"),
+			body,
+			int64(file.UncompressedSize64),
+			mime.TypeByExtension(path.Ext(name)),
+		)
+		body.Close()
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+	if published == 0 {
+		return 0, errors.New("archive has no files")
+	}
+	return published, nil
+}
+
+// Get a file of the site's active build. Paths ending in / get their index.html and paths that
+// don't exist fall back to the root index.html so single page apps can do their own routing.
+func (ss *StorageService) GetFile(ctx context.Context, site *models.Site, filePath string) (*storage.Object, error) {
+	if site.ActiveBuildID == nil {
+		return nil, storage.ErrNotFound
+	}
+	prefix := buildPrefix(site.ID.String(), site.ActiveBuildID.String())
+
+	name := path.Clean("/" + filePath)
+	if strings.HasSuffix(filePath, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	object, err := ss.store.Get(ctx, prefix+strings.TrimPrefix(name, "/"))
+	if errors.Is(err, storage.ErrNotFound) {
+		return ss.store.Get(ctx, prefix+"index.html")
+	}
+	return object, err
+}
+
+// Deletes the files of every build of a site
+func (ss *StorageService) DeleteSite(ctx context.Context, siteId string) error {
+	return ss.store.DeleteAll(ctx, "sites/"+siteId+"/")
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cloudbase-Project/static-site-hosting/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUploadOffsetMismatch = errors.New("offset doesn't match the upload")
+	ErrUploadIncomplete     = errors.New("upload is not complete")
+	ErrUploadChecksum       = errors.New("checksum doesn't match the upload")
+	ErrUploadNoChecksum     = errors.New("a checksum is required to commit the upload")
+	ErrUploadCommitted      = errors.New("upload is already committed")
+)
+
+// Stores resumable uploads on disk until they are committed.
+type UploadService struct {
+	db  *gorm.DB
+	l   *log.Logger
+	dir string
+	ttl time.Duration
+
+	// chunks of an upload are written one at a time, and it is committed once
+	mu    sync.Mutex
+	locks map[uuid.UUID]*sync.Mutex
+}
+
+func NewUploadService(db *gorm.DB, l *log.Logger, dir string, ttl time.Duration) *UploadService {
+	return &UploadService{db: db, l: l, dir: dir, ttl: ttl, locks: map[uuid.UUID]*sync.Mutex{}}
+}
+
+// path of the file the chunks of an upload are written to
+func (us *UploadService) filePath(upload *models.Upload) string {
+	return filepath.Join(us.dir, upload.ID.String())
+}
+
+// Locks an upload against other chunks and commits. Returns the unlock function.
+func (us *UploadService) Lock(id uuid.UUID) func() {
+	us.mu.Lock()
+	l, ok := us.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		us.locks[id] = l
+	}
+	us.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Start an upload of length bytes. checksum is the sha256 of the whole upload in hex.
+func (us *UploadService) CreateUpload(siteId uuid.UUID, length int64, checksum string) (*models.Upload, error) {
+	upload := models.Upload{
+		ID:        uuid.New(),
+		SiteID:    siteId,
+		Length:    length,
+		Checksum:  strings.ToLower(checksum),
+		ExpiresAt: time.Now().Add(us.ttl),
+	}
+	if err := os.MkdirAll(us.dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(us.filePath(&upload))
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	if err := us.db.Create(&upload).Error; err != nil {
+		os.Remove(us.filePath(&upload))
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (us *UploadService) GetUpload(siteId uuid.UUID, uploadId string) (*models.Upload, error) {
+	var upload models.Upload
+	if err := us.db.Where(&models.Upload{SiteID: siteId}).First(&upload, "id = ?", uploadId).Error; err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+/*
+Appends a chunk at offset, which has to be the upload's current offset. Bytes past the
+upload's length are not read. Whatever was written before the body ended is kept, so a
+dropped connection can resume from the new offset.
+*/
+func (us *UploadService) WriteChunk(upload *models.Upload, offset int64, body io.Reader) error {
+	unlock := us.Lock(upload.ID)
+	defer unlock()
+
+	// the offset may have moved since the upload was read
+	if err := us.db.First(upload, "id = ?", upload.ID).Error; err != nil {
+		return err
+	}
+	if upload.BuildID != nil {
+		return ErrUploadCommitted
+	}
+	if offset != upload.Offset {
+		return ErrUploadOffsetMismatch
+	}
+
+	file, err := os.OpenFile(us.filePath(upload), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	written, copyErr := io.Copy(file, io.LimitReader(body, upload.Length-offset))
+	if err := file.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(us.ttl)
+	err = us.db.Model(upload).Updates(map[string]interface{}{
+		"offset":     upload.Offset,
+		"expires_at": upload.ExpiresAt,
+	}).Error
+	if copyErr != nil {
+		return copyErr
+	}
+	return err
+}
+
+/*
+Reads a complete upload after checking its checksum. checksum overrides the one given when
+the upload was created. Uploads from before a checksum was required have to be given one.
+
+Callers that build the upload hold its Lock until it is committed.
+*/
+func (us *UploadService) ReadComplete(upload *models.Upload, checksum string) ([]byte, error) {
+	// another commit may have finished since the upload was read
+	if err := us.db.First(upload, "id = ?", upload.ID).Error; err != nil {
+		return nil, err
+	}
+	if upload.BuildID != nil {
+		return nil, ErrUploadCommitted
+	}
+	if upload.Offset != upload.Length {
+		return nil, ErrUploadIncomplete
+	}
+
+	data, err := ioutil.ReadFile(us.filePath(upload))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != upload.Length {
+		return nil, ErrUploadIncomplete
+	}
+
+	if checksum == "" {
+		checksum = upload.Checksum
+	}
+	if checksum == "" {
+		return nil, ErrUploadNoChecksum
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+		return nil, ErrUploadChecksum
+	}
+	return data, nil
+}
+
+/*
+Marks the upload as built and removes its chunks. Returns ErrUploadCommitted if it was
+committed to another build first, eg: by another replica.
+*/
+func (us *UploadService) Commit(upload *models.Upload, buildId uuid.UUID) error {
+	result := us.db.Model(&models.Upload{}).
+		Where("id = ? AND build_id IS NULL", upload.ID).
+		Update("build_id", buildId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUploadCommitted
+	}
+	upload.BuildID = &buildId
+	us.removeFile(upload)
+	return nil
+}
+
+// Cancels an upload
+func (us *UploadService) DeleteUpload(upload *models.Upload) error {
+	if err := us.db.Delete(upload).Error; err != nil {
+		return err
+	}
+	us.removeFile(upload)
+	return nil
+}
+
+// Deletes uploads that weren't committed before they expired
+func (us *UploadService) DeleteExpired() error {
+	var uploads []*models.Upload
+	if err := us.db.Where("build_id IS NULL AND expires_at < ?", time.Now()).Find(&uploads).Error; err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := us.DeleteUpload(upload); err != nil {
+			return err
+		}
+	}
+	if len(uploads) > 0 {
+		us.l.Print("deleted ", len(uploads), " expired uploads")
+	}
+	return nil
+}
+
+func (us *UploadService) removeFile(upload *models.Upload) {
+	if err := os.Remove(us.filePath(upload)); err != nil && !os.IsNotExist(err) {
+		us.l.Print("error removing upload ", upload.ID, " : ", err)
+	}
+	us.mu.Lock()
+	delete(us.locks, upload.ID)
+	us.mu.Unlock()
+}
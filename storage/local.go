@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stores objects as files under a root directory on local disk.
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+// Maps a key to a path inside the root directory.
+func (ls *LocalStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", errors.New("invalid key " + key)
+	}
+	return filepath.Join(ls.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (ls *LocalStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file so readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (ls *LocalStore) Get(ctx context.Context, key string) (*Object, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrNotFound
+	}
+	return &Object{
+		Body:         file,
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: info.ModTime(),
+		ETag:         `"` + strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36) + `"`,
+	}, nil
+}
+
+func (ls *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// Objects are files, so the prefix is expected to end at a directory. eg: sites/<siteId>/
+func (ls *LocalStore) DeleteAll(ctx context.Context, prefix string) error {
+	p, err := ls.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
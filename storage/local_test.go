@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(filepath.Join(t.TempDir(), "sitefiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store, "sites/site/")
+}
+
+func TestLocalStorePaths(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "sitefiles")
+	store, err := NewLocalStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// keys can't leave the root
+	putString(t, store, "../../outside.html", "inside", "text/html")
+	if _, err := os.Stat(filepath.Join(dir, "outside.html")); !os.IsNotExist(err) {
+		t.Error("key was written outside the root")
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(root, "outside.html")); string(content) != "inside" {
+		t.Errorf("key wasn't written inside the root : %q", content)
+	}
+
+	for _, key := range []string{"", "/", ".."} {
+		if err := store.Put(ctx, key, strings.NewReader(""), 0, ""); err == nil {
+			t.Errorf("Put of %q succeeded", key)
+		}
+		if err := store.DeleteAll(ctx, key); err == nil {
+			t.Errorf("DeleteAll of %q succeeded, it would delete the root", key)
+		}
+	}
+
+	// directories aren't objects
+	putString(t, store, "sites/site/index.html", "", "text/html")
+	if _, err := store.Get(ctx, "sites/site"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a directory : err = %v, want ErrNotFound", err)
+	}
+	if exists(t, store, "sites/site") {
+		t.Error("directory exists as an object")
+	}
+
+	// a failed write leaves the old object and no temporary files
+	if err := store.Put(ctx, "sites/site/index.html", failingReader{}, 10, "text/html"); err == nil {
+		t.Fatal("Put of a failing body succeeded")
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(root, "sites", "site"))
+	if len(files) != 1 {
+		t.Errorf("files after a failed write = %v", len(files))
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
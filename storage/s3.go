@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type S3Options struct {
+	Endpoint  string // eg: http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// Stores objects in an S3 compatible bucket (AWS S3, MinIO). Requests use path style
+// addressing and are signed with AWS signature version 4.
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Store(options S3Options) (*S3Store, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required")
+	}
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	region := options.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    options.Bucket,
+		accessKey: options.AccessKey,
+		secretKey: options.SecretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (*Object, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s.responseError(resp)
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &Object{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: lastModified,
+		ETag:         resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("s3: head %v returned %v", key, resp.Status)
+}
+
+func (s *S3Store) DeleteAll(ctx context.Context, prefix string) error {
+	keys, err := s.list(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+		if err != nil {
+			return err
+		}
+		s.sign(req)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("s3: deleting %v returned %v", key, resp.Status)
+		}
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Lists every key that starts with prefix
+func (s *S3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, s.responseError(resp)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Store) newRequest(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	body io.Reader,
+) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + strings.TrimPrefix(key, "/")
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+func (s *S3Store) responseError(resp *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %v %v", resp.Status, strings.TrimSpace(string(message)))
+}
+
+// Signs the request with AWS signature version 4. The payload is not signed.
+func (s *S3Store) sign(req *http.Request) {
+	s.signAt(req, time.Now(), "UNSIGNED-PAYLOAD")
+}
+
+// Signs the request as of now, with the hex sha256 of the payload or UNSIGNED-PAYLOAD
+func (s *S3Store) signAt(req *http.Request, now time.Time, payloadHash string) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set(
+		"Authorization",
+		"AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+			", SignedHeaders="+signedHeaders+
+			", Signature="+signature,
+	)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// URI encodes a path the way signature version 4 expects. Slashes are kept.
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Query string with keys sorted and values URI encoded.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncode(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
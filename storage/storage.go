@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// An object read from a blob store. Body must be closed by the caller.
+type Object struct {
+	Body         io.ReadCloser
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	ETag         string
+}
+
+// A store for the files of sites served directly by the proxy.
+// Keys are slash separated paths. eg: sites/<siteId>/<buildId>/index.html
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (*Object, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	// Deletes every object whose key starts with prefix
+	DeleteAll(ctx context.Context, prefix string) error
+}
+
+// Creates the blob store configured by the STORAGE_BACKEND env variable. Defaults to local disk.
+func NewFromEnv() (BlobStore, error) {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "s3":
+		return NewS3Store(S3Options{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	case "local", "":
+		root, ok := os.LookupEnv("STORAGE_LOCAL_DIR")
+		if !ok {
+			root = "./sitefiles"
+		}
+		return NewLocalStore(root)
+	default:
+		return nil, errors.New("unknown STORAGE_BACKEND " + os.Getenv("STORAGE_BACKEND"))
+	}
+}
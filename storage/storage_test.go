@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func putString(t *testing.T, store BlobStore, key string, content string, contentType string) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), contentType); err != nil {
+		t.Fatalf("Put %v : %v", key, err)
+	}
+}
+
+func getString(t *testing.T, store BlobStore, key string) (string, *Object) {
+	t.Helper()
+	object, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get %v : %v", key, err)
+	}
+	defer object.Body.Close()
+	content, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content), object
+}
+
+func exists(t *testing.T, store BlobStore, key string) bool {
+	t.Helper()
+	ok, err := store.Exists(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Exists %v : %v", key, err)
+	}
+	return ok
+}
+
+// Checks a store against what the proxy and the publisher expect of one. Keys are under prefix.
+func testStore(t *testing.T, store BlobStore, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	index := prefix + "build/index.html"
+	// a key that has to be encoded
+	asset := prefix + "build/static/my file+1 é.js"
+
+	if _, err := store.Get(ctx, index); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key : err = %v, want ErrNotFound", err)
+	}
+	if exists(t, store, index) {
+		t.Fatal("missing key exists")
+	}
+
+	putString(t, store, index, "<html></html>", "text/html")
+	putString(t, store, asset, "console.log(1)", "application/javascript")
+
+	content, object := getString(t, store, index)
+	if content != "<html></html>" || object.Size != int64(len(content)) {
+		t.Errorf("Get = %q of size %v", content, object.Size)
+	}
+	if !strings.HasPrefix(object.ContentType, "text/html") {
+		t.Errorf("content type = %q", object.ContentType)
+	}
+	if object.ETag == "" || object.LastModified.IsZero() {
+		t.Errorf("object has no ETag or Last-Modified : %+v", object)
+	}
+	if content, _ := getString(t, store, asset); content != "console.log(1)" {
+		t.Errorf("Get %v = %q", asset, content)
+	}
+	if !exists(t, store, asset) {
+		t.Error("put key doesn't exist")
+	}
+
+	// objects are replaced as a whole
+	putString(t, store, index, "v2", "text/html")
+	if content, _ := getString(t, store, index); content != "v2" {
+		t.Errorf("Get after Put = %q", content)
+	}
+
+	// only the keys under the prefix are deleted
+	putString(t, store, prefix+"other/index.html", "other", "text/html")
+	if err := store.DeleteAll(ctx, prefix+"build/"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t, store, index) || exists(t, store, asset) {
+		t.Error("DeleteAll left keys under the prefix")
+	}
+	if !exists(t, store, prefix+"other/index.html") {
+		t.Error("DeleteAll deleted a key outside the prefix")
+	}
+	if err := store.DeleteAll(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteAll(ctx, prefix+"missing/"); err != nil {
+		t.Errorf("DeleteAll of a missing prefix : %v", err)
+	}
+}
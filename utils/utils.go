@@ -4,18 +4,48 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
-// returns a fully qualified image name given a site id.
+// returns a fully qualified image name given a site id and the tag of a build.
 //
-// eg: quay.io/ubuntu-project/ubuntu:latest
-func BuildImageName(siteId string) string {
-	// TODO: implement this
-	Registry := "ghcr.io"
-	Project := "cloudbase-project"
+// eg: quay.io/ubuntu-project/ubuntu:b3-9f86d081884c
+func BuildImageName(siteId string, tag string) string {
+	return BuildImageRepository(siteId) + ":" + tag
+}
+
+// returns the image repository of a site. REGISTRY and PROJECT_NAME are read from env variables
+//
+// eg: quay.io/ubuntu-project/ubuntu
+func BuildImageRepository(siteId string) string {
+	Registry, ok := os.LookupEnv("REGISTRY")
+	if !ok {
+		Registry = "ghcr.io"
+	}
+	Project, ok := os.LookupEnv("PROJECT_NAME")
+	if !ok {
+		Project = "cloudbase-project"
+	}
+	return Registry + "/" + Project + "/" + siteId
+}
+
+// returns the immutable tag of a build from its number and the sha256 of the uploaded archive
+//
+// eg: b3-9f86d081884c
+func BuildImageTag(buildNumber int, checksum string) string {
+	if len(checksum) > 12 {
+		checksum = checksum[:12]
+	}
+	return "b" + strconv.Itoa(buildNumber) + "-" + checksum
+}
 
-	imageName := Registry + "/" + Project + "/" + siteId + ":latest"
-	return imageName
+// returns an image reference pinned to a digest given a site id.
+//
+// eg: quay.io/ubuntu-project/ubuntu@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+func BuildPinnedImageName(siteId string, digest string) string {
+	return BuildImageRepository(siteId) + "@" + digest
 }
 
 func FromJSON(body io.Reader, value interface{}) interface{} {
@@ -30,6 +60,30 @@ func BuildServiceName(siteId string) string {
 	return "cloudbase-ssh-" + siteId + "-svc"
 }
 
+// returns the name of the namespace of a project's sites given the id of its config
+//
+// eg: cloudbase-ssh-9d3e7c4e-0a0b-4c8d-9e1f-1a2b3c4d5e6f
+func BuildProjectNamespace(configId string) string {
+	return "cloudbase-ssh-" + configId
+}
+
+// returns the fully qualified name of a service, which resolves from every namespace
+//
+// eg: cloudbase-ssh-svc.default.svc.cluster.local
+func ServiceHost(name string, namespace string) string {
+	return name + "." + namespace + ".svc." + GetEnv("CLUSTER_DOMAIN", "cluster.local")
+}
+
+// returns the name of the image builder pod for an attempt of a build
+//
+// eg: kaniko-5f0c1a2b-9d3e7c4e-0a0b-4c8d-9e1f-1a2b3c4d5e6f-1
+func BuildImageBuilderName(siteId string, buildId string, attempt int) string {
+	if len(siteId) > 8 {
+		siteId = siteId[:8]
+	}
+	return "kaniko-" + siteId + "-" + buildId + "-" + strconv.Itoa(attempt)
+}
+
 // set http headers
 func SetSSEHeaders(rw http.ResponseWriter) http.ResponseWriter {
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
@@ -39,3 +93,29 @@ func SetSSEHeaders(rw http.ResponseWriter) http.ResponseWriter {
 	rw.Header().Set("Connection", "keep-alive")
 	return rw
 }
+
+// returns the value of an env variable or the fallback if its not set
+func GetEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// returns the integer value of an env variable or the fallback if its not set or invalid
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// returns the duration value (eg: 10m) of an env variable or the fallback if its not set or invalid
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}